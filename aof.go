@@ -1,140 +1,270 @@
 package main
 
 import (
-	"bufio"
-	"io"
+	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
-	"strconv"
+
+	appendonly "github.com/IAmRiteshKoushik/bluedis/aof"
+	"github.com/IAmRiteshKoushik/bluedis/resp"
 )
 
 type Aof struct {
-	file *os.File      // Hold the file descriptor
-	rd   *bufio.Reader // Read RESP commands for the file for reconstruction
+	file *os.File // The last incr file, where writes go
 	mu   sync.Mutex
+
+	dir      string               // Directory holding every file of the AOF
+	name     string               // appendfilename, the prefix of every file name
+	manifest *appendonly.Manifest // Files currently making up the AOF
+
+	size     int64 // Current size of all the files together, in bytes
+	baseSize int64 // Size right after startup or the last rewrite
+
+	rewriting   bool // A background rewrite is in progress
+	rewriteIncr int  // First incr file written since the rewrite started
+	closed      bool
+
+	fsync   string // appendfsync policy: always, everysec or no
+	written int64  // Bytes ever written, unlike size it survives rewrites
+
+	timestamps    bool  // Annotate writes with their time, see SetTimestamps
+	lastTimestamp int64 // Unix time of the last annotation in the incr file
+	rewriteStart  time.Time
+
+	selectedDB int // Database the incr file is at, -1 until its first SELECT
+
+	syncMu   sync.Mutex
+	syncCond *sync.Cond
+	syncing  bool  // An fsync is running, others wait for it to finish
+	synced   int64 // Value of written covered by the last fsync
+
+	stop chan struct{} // Closed by Close to stop the background syncer
+	done chan struct{} // Closed by the background syncer once it returned
 }
 
-func NewAof(path string) (*Aof, error) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+// NewAof opens the AOF made of the files named after name in dir (see
+// appendonly.Manifest), creating it if needed. A single file AOF named name in
+// the working directory, as older versions wrote it, becomes its base file.
+func NewAof(dir, name string) (*Aof, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	manifestPath := filepath.Join(dir, name+".manifest")
+	m, err := appendonly.LoadManifest(manifestPath)
 	if err != nil {
 		return nil, err
 	}
+	if m == nil {
+		m = &appendonly.Manifest{}
+		if info, err := os.Stat(name); err == nil && info.Mode().IsRegular() {
+			// The manifest goes first: should the server die before the
+			// file is moved, the old file is still where it was
+			m.Base = &appendonly.File{Name: fmt.Sprintf("%s.1.base.aof", name), Seq: 1, Type: appendonly.FileBase}
+			if err := appendonly.WriteManifest(manifestPath, m); err != nil {
+				return nil, err
+			}
+			if err := os.Rename(name, filepath.Join(dir, m.Base.Name)); err != nil {
+				return nil, err
+			}
+			fmt.Printf("Moved %s into %s as the base of the multi part AOF\n", name, dir)
+		}
+	}
 
 	aof := &Aof{
-		file: f,
-		rd:   bufio.NewReader(f),
+		dir:        dir,
+		name:       name,
+		manifest:   m,
+		fsync:      FsyncEverySec,
+		selectedDB: -1,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
 	}
+	aof.syncCond = sync.NewCond(&aof.syncMu)
 
-	// At the time of initialization, we spawn a goroutine which syncs the AOF
-	// to disk every 1 second. If we have not setup 1 second then the program
-	// becomes OS dependent on when to flush the file contents to the disk but as
-	// we have setup 1 second, we can lose data only within this span in the worst
-	// case scenario.
-	go func() {
-		for {
-			aof.mu.Lock()
-			aof.file.Sync()
-			aof.mu.Unlock()
-			time.Sleep(time.Second)
+	if n := len(m.Incrs); n > 0 {
+		aof.file, err = os.OpenFile(filepath.Join(dir, m.Incrs[n-1].Name), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, err
+		}
+	} else if err := aof.openIncr(); err != nil {
+		return nil, err
+	}
+
+	for _, f := range m.Files() {
+		info, err := os.Stat(filepath.Join(dir, f.Name))
+		if err != nil {
+			aof.file.Close()
+			return nil, err
 		}
-	}()
+		aof.size += info.Size()
+	}
+	aof.baseSize = aof.size
 
-	// Alternate approach is to sync the file everytime a command is successfully
-	// executed but this can result in poor performance for write operations
-	// because IO ops are expensive.
+	// At the time of initialization, we spawn a goroutine which syncs the AOF
+	// to disk every 1 second when the policy is everysec (the default). If we
+	// have not setup 1 second then the program becomes OS dependent on when to
+	// flush the file contents to the disk but as we have setup 1 second, we can
+	// lose data only within this span in the worst case scenario. See
+	// SetFsync for the other policies.
+	go aof.syncLoop()
 
 	return aof, nil
 }
 
+// openIncr starts a new incr file and makes it the one writes go to. The
+// previous one is synced and closed: it will not change anymore.
+func (aof *Aof) openIncr() error {
+	seq := 1
+	if n := len(aof.manifest.Incrs); n > 0 {
+		seq = aof.manifest.Incrs[n-1].Seq + 1
+	}
+	incr := appendonly.File{Name: fmt.Sprintf("%s.%d.incr.aof", aof.name, seq), Seq: seq, Type: appendonly.FileIncr}
+
+	path := filepath.Join(aof.dir, incr.Name)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	m := &appendonly.Manifest{Base: aof.manifest.Base, Incrs: append(slices.Clone(aof.manifest.Incrs), incr)}
+	if err := appendonly.WriteManifest(aof.manifestPath(), m); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+
+	if aof.file != nil {
+		aof.file.Sync()
+		aof.file.Close()
+	}
+	aof.file = f
+	aof.manifest = m
+	aof.lastTimestamp = 0
+	aof.selectedDB = -1
+	return nil
+}
+
+func (aof *Aof) manifestPath() string {
+	return filepath.Join(aof.dir, aof.name+".manifest")
+}
+
 func (aof *Aof) Close() error {
 	// Closing the file when the server is shutting down. If we do not acquire
 	// the lock then we can run into problems where some garbage value gets
 	// written as a race condition between server shutting down and a goroutine
 	// trying to write to the AOF
 
+	close(aof.stop)
+	<-aof.done
+
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
+	aof.closed = true
+	// Whatever the policy, nothing written before a clean shutdown is lost
+	aof.file.Sync()
 	return aof.file.Close()
 }
 
-func (aof *Aof) Write(value Value) error {
+// WriteDB appends commands that act on database db to the AOF. Commands passed
+// together are written with a single call so that they either all make it to
+// the file or none of them does. A SELECT goes first when the commands before
+// them in the incr file were for another database, so that replaying the file
+// applies every command to the right one. Every incr file starts with a
+// SELECT, its commands never depend on the files before it.
+func (aof *Aof) WriteDB(db int, values ...resp.Value) error {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
+	if db != aof.selectedDB {
+		values = append([]resp.Value{selectValue(db)}, values...)
+	}
+	if err := aof.write(values); err != nil {
+		aof.selectedDB = -1
+		return err
+	}
+	aof.selectedDB = db
+	return nil
+}
+
+func (aof *Aof) write(values []resp.Value) error {
 	// We are writing to the AOF file in RESP format using the Marshal() method
 	// so that if we have to reconstruct then we can run all the commands of that
 	// file in a loop without any pre-processing requirement
-	_, err := aof.file.Write(value.Marshal())
-	if err != nil {
-		return err
+	var data []byte
+	if aof.timestamps {
+		if now := time.Now().Unix(); now != aof.lastTimestamp {
+			data = appendonly.TimestampAnnotation(now)
+			aof.lastTimestamp = now
+		}
 	}
-
-	return nil
+	for _, value := range values {
+		data = append(data, value.Marshal()...)
+	}
+	n, err := aof.file.Write(data)
+	aof.size += int64(n)
+	aof.written += int64(n)
+	return err
 }
 
-func (aof *Aof) Read(callback func(value Value)) error {
+// Read feeds every command stored in the AOF to callback, in order. See
+// appendonly.Manifest.Read for the errors it returns.
+func (aof *Aof) Read(callback func(value resp.Value)) error {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
-	aof.file.Seek(0, io.SeekStart)
-	resp := NewResp(aof.file)
-
-	for {
-		value, err := resp.Read()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
-		}
-		callback(value)
-	}
-
-	return nil
+	return aof.manifest.Read(aof.dir, callback)
 }
 
-// My own functions
+// Truncate cuts the last file of the AOF at offset, dropping a partially
+// written command left at its end (see TruncatedError).
+func (aof *Aof) Truncate(offset int64) error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
 
-func (aof *Aof) WriteExpire(key string, ttl int, condition string) error {
-	args := []Value{
-		{typ: "bulk", bulk: "EXPIRE"},
-		{typ: "bulk", bulk: key},
-		{typ: "bulk", bulk: strconv.Itoa(ttl)},
+	info, err := aof.file.Stat()
+	if err != nil {
+		return err
 	}
-	if condition != "" {
-		args = append(args, Value{typ: "bulk", bulk: condition})
+	if err := aof.file.Truncate(offset); err != nil {
+		return err
 	}
-	value := Value{typ: "array", array: args}
-	return aof.Write(value)
+	aof.size -= info.Size() - offset
+	aof.baseSize = aof.size
+	return aof.file.Sync()
 }
 
-// WriteDel converts the DEL command and its arguments into RESP format
-func (aof *Aof) WriteDel(keys []string) error {
-	args := []Value{{typ: "bulk", bulk: "DEL"}}
-	for _, key := range keys {
-		args = append(args, Value{typ: "bulk", bulk: key})
-	}
-	value := Value{typ: "array", array: args}
-	return aof.Write(value)
+// SetTimestamps turns the timestamp annotations on or off. They start with the
+// next write.
+func (aof *Aof) SetTimestamps(enabled bool) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	aof.timestamps = enabled
+	aof.lastTimestamp = 0
 }
 
-// WriteSet converts the SET command and its arguments into RESP format
-// WriteSet converts the SET command and its arguments into RESP format,
-// optionally including expiry information.
-func (aof *Aof) WriteSet(key, value string, args ...string) error {
-	commandArgs := []Value{{typ: "bulk", bulk: "SET"}, {typ: "bulk", bulk: key}, {typ: "bulk", bulk: value}}
-
-	// Check for expiry arguments (EX or PX)
-	for i := 0; i < len(args); i++ {	
-		commandArgs = append(commandArgs, Value{typ: "bulk", bulk: args[i]})
-		if i+1 < len(args) {
-			commandArgs = append(commandArgs, Value{typ: "bulk", bulk: args[i+1]})
-			break // Consume both EX/PX and the time
-		}
+func selectValue(db int) resp.Value {
+	args := []resp.Value{
+		{Typ: "bulk", Bulk: "SELECT"},
+		{Typ: "bulk", Bulk: strconv.Itoa(db)},
 	}
+	return resp.Value{Typ: "array", Array: args}
+}
 
-	respValue := Value{typ: "array", array: commandArgs}
-	return aof.Write(respValue)
-}
\ No newline at end of file
+// expireValue records the deadline of a key as PEXPIREAT with an absolute unix
+// time in milliseconds. Logging the relative TTL instead would restart the
+// countdown every time the AOF is replayed.
+func expireValue(key string, deadline time.Time) resp.Value {
+	args := []resp.Value{
+		{Typ: "bulk", Bulk: "PEXPIREAT"},
+		{Typ: "bulk", Bulk: key},
+		{Typ: "bulk", Bulk: strconv.FormatInt(deadline.UnixMilli(), 10)},
+	}
+	return resp.Value{Typ: "array", Array: args}
+}
@@ -0,0 +1,165 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// TruncatedError means the AOF ends in the middle of a command, which is what
+// a crash while appending to it leaves behind. Everything before Offset is
+// made of complete commands.
+type TruncatedError struct {
+	File   string // Path of the file, set when reading a whole AOF
+	Offset int64  // End of the last complete command
+	Size   int64  // Size of the file
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("unexpected end of file at offset %d: the last %d bytes do not form a complete command", e.Size, e.Size-e.Offset)
+}
+
+// CorruptError means the AOF holds something that is not a valid command. The
+// first invalid byte is somewhere after Offset.
+type CorruptError struct {
+	File   string // Path of the file, set when reading a whole AOF
+	Offset int64  // End of the last valid command
+	Err    error
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("bad file format at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
+// scanCommands reads every command from r, a file of the given size, and
+// passes it to callback. A snapshot preamble at the start of the file is
+// passed on as the commands that recreate its keys, and annotations between
+// commands are skipped. It returns the offset up to which the file is made of
+// complete, well formed commands and the size of the preamble, 0 when there is
+// none. With a limit, errLimitReached and the offset the file can be cut at
+// are returned as soon as the limit is reached.
+func scanCommands(r io.Reader, size int64, limit *ReplayLimit, callback func(value resp.Value)) (valid, preamble int64, err error) {
+	// emit passes a command on, unless the limit does not let it through
+	emit := func(value resp.Value) bool {
+		if limit != nil {
+			if limit.Commands > 0 && limit.replayed >= limit.Commands {
+				return false
+			}
+			limit.replayed++
+		}
+		if callback != nil {
+			callback(value)
+		}
+		return true
+	}
+
+	rd := bufio.NewReader(r)
+	if magic, _ := rd.Peek(len(snapshotMagic)); string(magic) == snapshotMagic {
+		reached := false
+		db := 0
+		preamble, err = ScanSnapshot(rd, func(rec SnapshotRecord) {
+			commands := rec.commands()
+			if rec.DB != db {
+				commands = append([]resp.Value{selectValue(rec.DB)}, commands...)
+				db = rec.DB
+			}
+			for _, command := range commands {
+				if !emit(command) {
+					reached = true
+				}
+			}
+		})
+		if err != nil {
+			// No valid command can follow a broken preamble
+			return 0, preamble, &CorruptError{Offset: 0, Err: fmt.Errorf("snapshot preamble: %w", err)}
+		}
+		if reached {
+			return 0, preamble, errors.New("the recovery point is inside the snapshot preamble")
+		}
+		valid = preamble
+	}
+
+	reader := resp.NewResp(rd)
+	for {
+		var value resp.Value
+		annotation, ok, err := reader.ReadAnnotation()
+		if !ok && err == nil {
+			value, err = reader.ReadCommand()
+		}
+		offset := preamble + reader.Offset()
+		if err == io.EOF && offset == valid {
+			return valid, preamble, nil
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return valid, preamble, &TruncatedError{Offset: valid, Size: size}
+		}
+		if err != nil {
+			return valid, preamble, &CorruptError{Offset: valid, Err: err}
+		}
+
+		if ok {
+			if limit.after(annotation) {
+				return valid, preamble, errLimitReached
+			}
+			valid = offset
+			continue
+		}
+		if !emit(value) {
+			return valid, preamble, errLimitReached
+		}
+		valid = offset
+	}
+}
+
+// CheckResult is the outcome of CheckFile.
+type CheckResult struct {
+	Size     int64 // Size of the file
+	Preamble int64 // Size of the snapshot the file starts with, 0 if none
+	Valid    int64 // Offset up to which the file is made of complete commands
+	Commands int   // Number of complete commands, preamble included
+	Err      error // Nil, a *TruncatedError or a *CorruptError
+}
+
+// CheckFile scans an AOF file without applying it, to find out whether it is
+// complete and well formed and if not, from where it stops being so.
+func CheckFile(path string) (CheckResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return CheckResult{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return CheckResult{}, err
+	}
+
+	result := CheckResult{Size: info.Size()}
+	result.Valid, result.Preamble, result.Err = scanCommands(f, result.Size, nil, func(resp.Value) {
+		result.Commands++
+	})
+	return result, nil
+}
+
+// TruncateFile cuts the file at offset, which is how a damaged AOF is fixed
+// once CheckFile found where the valid part ends.
+func TruncateFile(path string, offset int64) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,190 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The AOF is split in several files kept in their own directory, like Redis 7
+// does. With appendfilename database.aof:
+//
+//	database.aof.1.base.aof   the dataset as of the last rewrite, if any
+//	database.aof.1.incr.aof   writes made since, oldest first
+//	database.aof.2.incr.aof
+//	database.aof.manifest     the files above that make up the AOF, in order
+//
+// Writes only ever go to the last incr file. A rewrite opens a new incr file
+// for the writes that follow, then writes a new base file next to the others
+// and switches the manifest over to it, so the files in use are never touched.
+// The manifest is replaced atomically: whenever the server stops, it lists a
+// consistent set of files.
+//
+// The manifest has one line per file:
+//
+//	file database.aof.1.base.aof seq 1 type b
+//	file database.aof.1.incr.aof seq 1 type i
+const (
+	FileBase = 'b'
+	FileIncr = 'i'
+)
+
+// File is one of the files making up an AOF.
+type File struct {
+	Name string
+	Seq  int
+	Type byte // FileBase or FileIncr
+}
+
+// Manifest lists the files making up an AOF.
+type Manifest struct {
+	Base  *File // Nil until the first rewrite
+	Incrs []File
+}
+
+// Files returns every file of the AOF in the order they are replayed.
+func (m *Manifest) Files() []File {
+	var files []File
+	if m.Base != nil {
+		files = append(files, *m.Base)
+	}
+	return append(files, m.Incrs...)
+}
+
+func (m *Manifest) Contains(f File) bool {
+	for _, other := range m.Files() {
+		if other == f {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manifest) encode() []byte {
+	var buf bytes.Buffer
+	for _, f := range m.Files() {
+		fmt.Fprintf(&buf, "file %s seq %d type %c\n", f.Name, f.Seq, f.Type)
+	}
+	return buf.Bytes()
+}
+
+func parseManifest(data []byte) (*Manifest, error) {
+	m := &Manifest{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid manifest line %d", line)
+		}
+
+		var f File
+		for i := 0; i < len(fields); i += 2 {
+			switch value := fields[i+1]; fields[i] {
+			case "file":
+				f.Name = value
+			case "seq":
+				seq, err := strconv.Atoi(value)
+				if err != nil || seq < 1 {
+					return nil, fmt.Errorf("invalid seq on manifest line %d", line)
+				}
+				f.Seq = seq
+			case "type":
+				f.Type = value[0]
+			}
+		}
+		if f.Name == "" || f.Seq == 0 || strings.ContainsRune(f.Name, '/') {
+			return nil, fmt.Errorf("invalid manifest line %d", line)
+		}
+
+		switch f.Type {
+		case FileBase:
+			if m.Base != nil || len(m.Incrs) > 0 {
+				return nil, fmt.Errorf("unexpected base file on manifest line %d", line)
+			}
+			m.Base = &f
+		case FileIncr:
+			if n := len(m.Incrs); n > 0 && m.Incrs[n-1].Seq >= f.Seq {
+				return nil, fmt.Errorf("incr files out of order on manifest line %d", line)
+			}
+			m.Incrs = append(m.Incrs, f)
+		default:
+			return nil, fmt.Errorf("unknown file type on manifest line %d", line)
+		}
+	}
+	return m, scanner.Err()
+}
+
+// LoadManifest reads the manifest at path. It returns nil and no error when
+// there is none yet.
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+// WriteManifest atomically replaces the manifest at path.
+func WriteManifest(path string, m *Manifest) error {
+	tmpPath := filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-%s", filepath.Base(path)))
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	if _, err := f.Write(m.encode()); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes the creation, removal and renaming of files in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// ManifestFiles returns the paths of the files that make up the AOF described
+// by the manifest at path, in the order they are replayed.
+func ManifestFiles(path string) ([]string, error) {
+	m, err := LoadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, os.ErrNotExist
+	}
+
+	var paths []string
+	for _, f := range m.Files() {
+		paths = append(paths, filepath.Join(filepath.Dir(path), f.Name))
+	}
+	return paths, nil
+}
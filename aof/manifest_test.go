@@ -0,0 +1,159 @@
+package aof
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// setTo returns SET key value as written to the AOF.
+func setTo(key, value string) string {
+	return fmt.Sprintf("*3\r\n$3\r\nSET\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(key), key, len(value), value)
+}
+
+// replay loads the AOF described by the manifest at path the way the server
+// does at startup, and returns the keys the SET and DEL commands left.
+func replay(t *testing.T, path string) map[string]string {
+	t.Helper()
+	m, err := LoadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]string{}
+	if m == nil {
+		return keys
+	}
+	err = m.Read(filepath.Dir(path), func(value resp.Value) {
+		switch args := value.Array; args[0].Bulk {
+		case "SET":
+			keys[args[1].Bulk] = args[2].Bulk
+		case "DEL":
+			delete(keys, args[1].Bulk)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// A rewrite goes through the steps below, the same the server takes. Should
+// it crash after any of them, the files the manifest lists must still hold
+// every write made so far.
+func TestRewriteCrash(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.aof.manifest")
+	file := func(name string) string { return filepath.Join(dir, name) }
+	write := func(name, data string) {
+		f, err := os.OpenFile(file(name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := func(m *Manifest) {
+		if err := WriteManifest(path, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	base1 := File{Name: "test.aof.1.base.aof", Seq: 1, Type: FileBase}
+	base2 := File{Name: "test.aof.2.base.aof", Seq: 2, Type: FileBase}
+	incr1 := File{Name: "test.aof.1.incr.aof", Seq: 1, Type: FileIncr}
+	incr2 := File{Name: "test.aof.2.incr.aof", Seq: 2, Type: FileIncr}
+	incr3 := File{Name: "test.aof.3.incr.aof", Seq: 3, Type: FileIncr}
+	before := map[string]string{"a": "1", "b": "2", "c": "3"}
+	after := map[string]string{"a": "4", "b": "2", "c": "3", "d": "5"}
+
+	steps := []struct {
+		name string
+		do   func()
+		want map[string]string
+	}{
+		{"an AOF rewritten once", func() {
+			write(base1.Name, setTo("a", "1")+setTo("b", "2"))
+			write(incr1.Name, setTo("c", "3"))
+			manifest(&Manifest{Base: &base1, Incrs: []File{incr1}})
+		}, before},
+		{"new incr file created", func() {
+			write(incr2.Name, "")
+		}, before},
+		{"new incr file listed", func() {
+			manifest(&Manifest{Base: &base1, Incrs: []File{incr1, incr2}})
+		}, before},
+		{"writes to the new incr file", func() {
+			write(incr2.Name, setTo("a", "4")+setTo("d", "5"))
+		}, after},
+		{"new base half written", func() {
+			write("temp-rewriteaof-bg-1.aof", setTo("a", "1")+"*3\r\n$3\r\nSE")
+		}, after},
+		{"new base written", func() {
+			write("temp-rewriteaof-bg-1.aof", "T\r\n$1\r\nb\r\n$1\r\n2\r\n"+setTo("c", "3"))
+			if err := os.Rename(file("temp-rewriteaof-bg-1.aof"), file(base2.Name)); err != nil {
+				t.Fatal(err)
+			}
+		}, after},
+		{"new manifest written but not in place", func() {
+			m := &Manifest{Base: &base2, Incrs: []File{incr2}}
+			if err := os.WriteFile(file("temp-test.aof.manifest"), m.encode(), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, after},
+		{"manifest switched to the new base", func() {
+			manifest(&Manifest{Base: &base2, Incrs: []File{incr2}})
+		}, after},
+		{"old files removed", func() {
+			for _, f := range []File{base1, incr1} {
+				if err := os.Remove(file(f.Name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}, after},
+		// A rewrite that never completes leaves its incr file in the AOF
+		{"next rewrite started", func() {
+			write(incr3.Name, setTo("a", "6"))
+			manifest(&Manifest{Base: &base2, Incrs: []File{incr2, incr3}})
+		}, map[string]string{"a": "6", "b": "2", "c": "3", "d": "5"}},
+	}
+	for _, step := range steps {
+		step.do()
+		if got := replay(t, path); !maps.Equal(got, step.want) {
+			t.Errorf("after %s the AOF holds %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	m, err := parseManifest([]byte("# comment\nfile a.1.base.aof seq 1 type b\n\nfile a.2.incr.aof seq 2 type i\nfile a.3.incr.aof type i seq 3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Base == nil || m.Base.Name != "a.1.base.aof" || len(m.Incrs) != 2 || m.Incrs[1].Seq != 3 {
+		t.Errorf("parsed %+v", m)
+	}
+	if data := string(m.encode()); data != "file a.1.base.aof seq 1 type b\nfile a.2.incr.aof seq 2 type i\nfile a.3.incr.aof seq 3 type i\n" {
+		t.Errorf("encoded as %q", data)
+	}
+
+	for _, data := range []string{
+		"file a.1.incr.aof seq 1\n",
+		"file a.1.incr.aof seq 0 type i\n",
+		"file a.1.incr.aof seq x type i\n",
+		"file ../a.1.incr.aof seq 1 type i\n",
+		"file a.1.incr.aof seq 1 type i extra\n",
+		"file a.2.incr.aof seq 2 type i\nfile a.1.incr.aof seq 1 type i\n",
+		"file a.1.incr.aof seq 1 type i\nfile a.1.base.aof seq 1 type b\n",
+		"file a.1.base.aof seq 1 type b\nfile a.2.base.aof seq 2 type b\n",
+	} {
+		if m, err := parseManifest([]byte(data)); err == nil {
+			t.Errorf("parseManifest(%q) = %+v, want an error", data, m)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package aof
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Point-in-time recovery. With aof-timestamp-enabled the AOF holds a
+// "#TS:<unix time>" annotation before the first command of every second.
+// PlanTruncation finds where to cut it right before a chosen time or after a
+// chosen number of commands, and Apply cuts it there, so that the next start
+// only replays what happened up to that point.
+
+// TimestampAnnotation returns the annotation written before the commands of
+// the given unix time.
+func TimestampAnnotation(unix int64) []byte {
+	return []byte(fmt.Sprintf("#TS:%d\r\n", unix))
+}
+
+// ReplayLimit is the point an AOF is cut at for point-in-time recovery. Either
+// field can be zero, for no limit of that kind.
+type ReplayLimit struct {
+	Timestamp int64 // Commands annotated with a later unix time are cut
+	Commands  int   // Number of commands kept, preamble keys included
+
+	replayed   int  // Commands kept so far, over every file of the AOF
+	timestamps bool // Whether a timestamp annotation was seen
+}
+
+var errLimitReached = errors.New("replay limit reached")
+
+// ErrNoTimestamps is returned when an AOF is to be cut at a time but holds no
+// timestamp annotation to find it by.
+var ErrNoTimestamps = errors.New("the AOF has no timestamps, aof-timestamp-enabled was off while it was written")
+
+// after reports whether an annotation marks commands made after the limit.
+func (limit *ReplayLimit) after(annotation string) bool {
+	ts, ok := strings.CutPrefix(annotation, "TS:")
+	if limit == nil || !ok {
+		return false
+	}
+	limit.timestamps = true
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	return limit.Timestamp != 0 && err == nil && unix > limit.Timestamp
+}
+
+// reachedIn returns an error when the limit was reached in file at a point the
+// AOF can't be cut at. The base holds the dataset as of the last rewrite, not
+// its history, and the annotation ending it tells when that was.
+func (limit *ReplayLimit) reachedIn(file File) error {
+	byCommands := limit.Commands > 0 && limit.replayed >= limit.Commands
+	if file.Type == FileBase && !byCommands {
+		return fmt.Errorf("the AOF does not go back to %s, it was last rewritten later",
+			time.Unix(limit.Timestamp, 0).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Cut is a part of an AOF that a Truncation drops.
+type Cut struct {
+	Path   string
+	Offset int64 // Where the file is cut, 0 when it is removed
+	Size   int64 // Size of the file, Size-Offset bytes are dropped
+	Remove bool  // Whether the whole file goes, listed in the manifest no more
+}
+
+// Truncation is the plan for cutting an AOF at a replay limit, made by
+// PlanTruncation and carried out by Apply.
+type Truncation struct {
+	Kept int   // Commands left once the AOF is cut
+	Cuts []Cut // What is dropped, nothing when the whole AOF is before the limit
+
+	manifestPath string
+	manifest     *Manifest // Manifest listing the files kept, nil if unchanged
+}
+
+// PlanTruncation finds where the AOF at path, a single file or the manifest of
+// a multi part AOF, has to be cut at the point given by limit. Nothing is
+// changed until Apply is called.
+func PlanTruncation(path string, limit ReplayLimit) (*Truncation, error) {
+	dir := filepath.Dir(path)
+	var m *Manifest
+	var files []File
+	if strings.HasSuffix(path, ".manifest") {
+		var err error
+		if m, err = LoadManifest(path); err != nil {
+			return nil, err
+		}
+		if m == nil {
+			return nil, os.ErrNotExist
+		}
+		files = m.Files()
+	} else {
+		files = []File{{Name: filepath.Base(path)}}
+	}
+
+	for i, file := range files {
+		filePath := filepath.Join(dir, file.Name)
+		valid, size, err := scanFile(filePath, &limit)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, errLimitReached) {
+			return nil, fmt.Errorf("%s: %w", filePath, err)
+		}
+		if err := limit.reachedIn(file); err != nil {
+			return nil, err
+		}
+
+		t := &Truncation{
+			Kept: limit.replayed,
+			Cuts: []Cut{{Path: filePath, Offset: valid, Size: size}},
+		}
+		for _, dropped := range files[i+1:] {
+			droppedPath := filepath.Join(dir, dropped.Name)
+			info, err := os.Stat(droppedPath)
+			if err != nil {
+				return nil, err
+			}
+			t.Cuts = append(t.Cuts, Cut{Path: droppedPath, Size: info.Size(), Remove: true})
+		}
+		if m != nil && i < len(files)-1 {
+			t.manifestPath = path
+			t.manifest = &Manifest{Base: m.Base}
+			if file.Type == FileIncr {
+				t.manifest.Incrs = files[:i+1]
+				if m.Base != nil {
+					t.manifest.Incrs = t.manifest.Incrs[1:]
+				}
+			}
+		}
+		return t, nil
+	}
+
+	if limit.Timestamp != 0 && !limit.timestamps {
+		return nil, ErrNoTimestamps
+	}
+	return &Truncation{Kept: limit.replayed}, nil
+}
+
+// Apply cuts the AOF as planned. The AOF must not be in use.
+func (t *Truncation) Apply() error {
+	if len(t.Cuts) == 0 {
+		return nil
+	}
+	if err := TruncateFile(t.Cuts[0].Path, t.Cuts[0].Offset); err != nil {
+		return err
+	}
+	if t.manifest != nil {
+		if err := WriteManifest(t.manifestPath, t.manifest); err != nil {
+			return err
+		}
+	}
+	for _, cut := range t.Cuts[1:] {
+		if err := os.Remove(cut.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanFile returns the offset the file at path can be cut at once limit is
+// reached, and its size.
+func scanFile(path string, limit *ReplayLimit) (valid, size int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	valid, _, err = scanCommands(f, info.Size(), limit, nil)
+	return valid, info.Size(), err
+}
@@ -0,0 +1,118 @@
+package aof
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// set returns a SET command as written to the AOF.
+func set(key string) string {
+	return fmt.Sprintf("*3\r\n$3\r\nSET\r\n$%d\r\n%s\r\n$1\r\nv\r\n", len(key), key)
+}
+
+// writeAOF writes a multi part AOF made of a base and incr files with the given
+// contents to dir, and returns the path of its manifest.
+func writeAOF(t *testing.T, dir, base string, incrs ...string) string {
+	t.Helper()
+	m := &Manifest{Base: &File{Name: "test.aof.1.base.aof", Seq: 1, Type: FileBase}}
+	if err := os.WriteFile(filepath.Join(dir, m.Base.Name), []byte(base), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i, incr := range incrs {
+		f := File{Name: fmt.Sprintf("test.aof.%d.incr.aof", i+1), Seq: i + 1, Type: FileIncr}
+		if err := os.WriteFile(filepath.Join(dir, f.Name), []byte(incr), 0644); err != nil {
+			t.Fatal(err)
+		}
+		m.Incrs = append(m.Incrs, f)
+	}
+	path := filepath.Join(dir, "test.aof.manifest")
+	if err := WriteManifest(path, m); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPlanTruncation(t *testing.T) {
+	dir := t.TempDir()
+	first := "#TS:100\r\n" + set("a") + "#TS:200\r\n" + set("b")
+	second := set("c") + "#TS:300\r\n" + set("d")
+	third := "#TS:400\r\n" + set("e")
+	path := writeAOF(t, dir, set("base"), first, second, third)
+
+	tr, err := PlanTruncation(path, ReplayLimit{Timestamp: 250})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Kept != 4 {
+		t.Errorf("%d commands kept, want 4", tr.Kept)
+	}
+	want := []Cut{
+		{Path: filepath.Join(dir, "test.aof.2.incr.aof"), Offset: int64(len(set("c"))), Size: int64(len(second))},
+		{Path: filepath.Join(dir, "test.aof.3.incr.aof"), Size: int64(len(third)), Remove: true},
+	}
+	if len(tr.Cuts) != len(want) || tr.Cuts[0] != want[0] || tr.Cuts[1] != want[1] {
+		t.Fatalf("cuts = %+v, want %+v", tr.Cuts, want)
+	}
+
+	// Planning changes nothing
+	if data, _ := os.ReadFile(filepath.Join(dir, "test.aof.2.incr.aof")); string(data) != second {
+		t.Error("planning changed the AOF")
+	}
+
+	if err := tr.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "test.aof.2.incr.aof")); string(data) != set("c") {
+		t.Errorf("cut file holds %q, want %q", data, set("c"))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test.aof.3.incr.aof")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the file after the cut is still there: %v", err)
+	}
+	m, err := LoadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := m.Files(); len(files) != 3 || files[2].Name != "test.aof.2.incr.aof" {
+		t.Errorf("manifest lists %+v, want the base and the first two incr files", files)
+	}
+}
+
+func TestPlanTruncationByCommands(t *testing.T) {
+	dir := t.TempDir()
+	path := writeAOF(t, dir, set("base"), set("a")+set("b"))
+
+	tr, err := PlanTruncation(path, ReplayLimit{Commands: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Kept != 2 || len(tr.Cuts) != 1 || tr.Cuts[0].Offset != int64(len(set("a"))) {
+		t.Errorf("got %+v, want the incr file cut after its first command", tr)
+	}
+
+	tr, err = PlanTruncation(path, ReplayLimit{Commands: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Kept != 3 || len(tr.Cuts) != 0 {
+		t.Errorf("got %+v, want the whole AOF kept", tr)
+	}
+}
+
+func TestPlanTruncationWithoutTimestamps(t *testing.T) {
+	path := writeAOF(t, t.TempDir(), set("base"), set("a")+set("b"))
+	if _, err := PlanTruncation(path, ReplayLimit{Timestamp: 100}); !errors.Is(err, ErrNoTimestamps) {
+		t.Errorf("got %v, want ErrNoTimestamps", err)
+	}
+}
+
+func TestPlanTruncationBeforeRewrite(t *testing.T) {
+	path := writeAOF(t, t.TempDir(), set("base")+"#TS:500\r\n", "#TS:600\r\n"+set("a"))
+	_, err := PlanTruncation(path, ReplayLimit{Timestamp: 100})
+	if err == nil || !strings.Contains(err.Error(), "last rewritten later") {
+		t.Errorf("got %v, want an error about the last rewrite", err)
+	}
+}
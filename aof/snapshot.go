@@ -0,0 +1,326 @@
+package aof
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// Snapshot file layout, used for SAVE/BGSAVE and as the preamble of a
+// rewritten AOF when aof-use-rdb-preamble is on:
+//
+//	"BLUEDIS" <version byte>
+//	records, each one of:
+//	  [0xFE <database: uvarint>]
+//	  [0xFC <deadline: 8 bytes, unix ms, little endian>] <type> <key> <payload>
+//	0xFF
+//	<CRC64 (ECMA) of everything above: 8 bytes, little endian>
+//
+// Strings (keys, values, fields, elements) are a uvarint length followed by the
+// bytes. A string payload is one string, a hash payload is a uvarint number of
+// fields followed by field/value pairs and a list payload is a uvarint number
+// of elements followed by the elements from head to tail. A hash some fields
+// of which expire has the payload of a hash with the deadline of each field
+// after its value, as a uvarint unix time in ms (0 for a field that does not
+// expire). The optional 0xFC prefix gives the deadline of the key that
+// follows, and 0xFE the database it and the keys after it belong to, database
+// 0 until the first one.
+const (
+	snapshotMagic   = "BLUEDIS"
+	snapshotVersion = 1
+
+	SnapshotTypeString  = 0
+	SnapshotTypeHash    = 1
+	SnapshotTypeList    = 2
+	SnapshotTypeHashTTL = 3
+	snapshotExpireMs    = 0xFC
+	snapshotSelectDB    = 0xFE
+	snapshotEOF         = 0xFF
+
+	snapshotMaxString = 512 * 1024 * 1024
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// SnapshotRecord is one key of a snapshot. Values holds the content of a
+// string, the fields and values of a hash one after the other, or the
+// elements of a list. For SnapshotTypeHashTTL, FieldDeadlines holds the
+// deadline of every field in the same order, zero for those without.
+type SnapshotRecord struct {
+	DB             int
+	Type           byte
+	Key            string
+	Deadline       time.Time // Zero when the key does not expire
+	Values         []string
+	FieldDeadlines []time.Time
+}
+
+// commands returns the commands that recreate the key of rec, which is how the
+// snapshot preamble of an AOF is replayed like the rest of the file.
+func (rec SnapshotRecord) commands() []resp.Value {
+	bulk := func(s string) resp.Value { return resp.Value{Typ: "bulk", Bulk: s} }
+	command := func(name string, args ...string) resp.Value {
+		array := []resp.Value{bulk(name), bulk(rec.Key)}
+		for _, arg := range args {
+			array = append(array, bulk(arg))
+		}
+		return resp.Value{Typ: "array", Array: array}
+	}
+
+	var commands []resp.Value
+	switch rec.Type {
+	case SnapshotTypeString:
+		commands = append(commands, command("SET", rec.Values[0]))
+	case SnapshotTypeHash, SnapshotTypeHashTTL:
+		for i := 0; i < len(rec.Values); i += 2 {
+			commands = append(commands, command("HSET", rec.Values[i], rec.Values[i+1]))
+		}
+		for i, deadline := range rec.FieldDeadlines {
+			if !deadline.IsZero() {
+				ms := strconv.FormatInt(deadline.UnixMilli(), 10)
+				commands = append(commands, command("HPEXPIREAT", ms, "FIELDS", "1", rec.Values[2*i]))
+			}
+		}
+	case SnapshotTypeList:
+		commands = append(commands, command("RPUSH", rec.Values...))
+	}
+	if !rec.Deadline.IsZero() {
+		commands = append(commands, command("PEXPIREAT", strconv.FormatInt(rec.Deadline.UnixMilli(), 10)))
+	}
+	return commands
+}
+
+// SnapshotWriter encodes records. It remembers the first error so that the
+// encoding code does not have to check after every single field.
+type SnapshotWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash64
+	db  int // Database of the last record
+	err error
+}
+
+// NewSnapshotWriter starts a snapshot on w, Close has to be called once every
+// record was written.
+func NewSnapshotWriter(w io.Writer) *SnapshotWriter {
+	sw := &SnapshotWriter{w: bufio.NewWriter(w), crc: crc64.New(crcTable)}
+	sw.write([]byte(snapshotMagic))
+	sw.writeByte(snapshotVersion)
+	return sw
+}
+
+// WriteRecord appends rec to the snapshot.
+func (sw *SnapshotWriter) WriteRecord(rec SnapshotRecord) {
+	if rec.DB != sw.db {
+		sw.writeByte(snapshotSelectDB)
+		sw.writeUvarint(uint64(rec.DB))
+		sw.db = rec.DB
+	}
+	if !rec.Deadline.IsZero() {
+		sw.writeByte(snapshotExpireMs)
+		sw.write(binary.LittleEndian.AppendUint64(nil, uint64(rec.Deadline.UnixMilli())))
+	}
+	sw.writeByte(rec.Type)
+	sw.writeString(rec.Key)
+	if rec.Type == SnapshotTypeString {
+		sw.writeString(rec.Values[0])
+		return
+	}
+
+	n := len(rec.Values)
+	if rec.Type == SnapshotTypeHash || rec.Type == SnapshotTypeHashTTL {
+		n /= 2
+	}
+	sw.writeUvarint(uint64(n))
+	for i, value := range rec.Values {
+		sw.writeString(value)
+		if rec.Type == SnapshotTypeHashTTL && i%2 == 1 {
+			var ms uint64
+			if deadline := rec.FieldDeadlines[i/2]; !deadline.IsZero() {
+				ms = uint64(deadline.UnixMilli())
+			}
+			sw.writeUvarint(ms)
+		}
+	}
+}
+
+// Close ends the snapshot with its checksum.
+func (sw *SnapshotWriter) Close() error {
+	sw.writeByte(snapshotEOF)
+	if sw.err != nil {
+		return sw.err
+	}
+
+	// The checksum itself is not part of what it covers
+	footer := binary.LittleEndian.AppendUint64(nil, sw.crc.Sum64())
+	if _, err := sw.w.Write(footer); err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+func (sw *SnapshotWriter) write(b []byte) {
+	if sw.err != nil {
+		return
+	}
+	sw.crc.Write(b)
+	_, sw.err = sw.w.Write(b)
+}
+
+func (sw *SnapshotWriter) writeByte(b byte) {
+	sw.write([]byte{b})
+}
+
+func (sw *SnapshotWriter) writeUvarint(n uint64) {
+	sw.write(binary.AppendUvarint(nil, n))
+}
+
+func (sw *SnapshotWriter) writeString(s string) {
+	sw.writeUvarint(uint64(len(s)))
+	sw.write([]byte(s))
+}
+
+// ScanSnapshot decodes a snapshot from r and passes every record to callback.
+// It returns the size of the snapshot, r is left right after it: in an AOF
+// with a snapshot preamble, that is where the commands start.
+func ScanSnapshot(r *bufio.Reader, callback func(rec SnapshotRecord)) (int64, error) {
+	sr := &snapshotReader{r: r, crc: crc64.New(crcTable)}
+
+	header := sr.read(len(snapshotMagic) + 1)
+	if sr.err != nil {
+		return sr.n, sr.err
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return sr.n, errors.New("wrong signature, not a Bluedis snapshot")
+	}
+	if header[len(snapshotMagic)] != snapshotVersion {
+		return sr.n, fmt.Errorf("can't handle snapshot format version %d", header[len(snapshotMagic)])
+	}
+
+	db := 0
+	for {
+		var rec SnapshotRecord
+		rec.Type = sr.readByte()
+		if rec.Type == snapshotSelectDB {
+			n := sr.readUvarint()
+			if sr.err == nil && n > math.MaxInt32 {
+				return sr.n, fmt.Errorf("invalid database index %d", n)
+			}
+			db = int(n)
+			continue
+		}
+		rec.DB = db
+		if rec.Type == snapshotExpireMs {
+			rec.Deadline = time.UnixMilli(int64(binary.LittleEndian.Uint64(sr.read(8))))
+			rec.Type = sr.readByte()
+		}
+		if sr.err != nil {
+			return sr.n, sr.err
+		}
+		if rec.Type == snapshotEOF {
+			break
+		}
+
+		rec.Key = sr.readString()
+		n := uint64(1)
+		switch rec.Type {
+		case SnapshotTypeString:
+		case SnapshotTypeHash:
+			n = 2 * sr.readUvarint()
+		case SnapshotTypeList:
+			n = sr.readUvarint()
+		case SnapshotTypeHashTTL:
+			n = 2 * sr.readUvarint()
+		default:
+			return sr.n, fmt.Errorf("unknown value type %d for key '%s'", rec.Type, rec.Key)
+		}
+		for i := uint64(0); i < n && sr.err == nil; i++ {
+			rec.Values = append(rec.Values, sr.readString())
+			if rec.Type == SnapshotTypeHashTTL && i%2 == 1 {
+				var deadline time.Time
+				if ms := sr.readUvarint(); ms != 0 {
+					deadline = time.UnixMilli(int64(ms))
+				}
+				rec.FieldDeadlines = append(rec.FieldDeadlines, deadline)
+			}
+		}
+		if sr.err != nil {
+			return sr.n, sr.err
+		}
+		callback(rec)
+	}
+
+	// Compare against the checksum of everything read so far
+	sum := sr.crc.Sum64()
+	footer := sr.read(8)
+	if sr.err != nil {
+		return sr.n, fmt.Errorf("missing checksum: %w", sr.err)
+	}
+	if binary.LittleEndian.Uint64(footer) != sum {
+		return sr.n, errors.New("wrong checksum, the snapshot is corrupted")
+	}
+	return sr.n, nil
+}
+
+// snapshotReader is the reading counterpart of SnapshotWriter. Once an error
+// happened every read returns zeroed bytes.
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash64
+	n   int64 // Bytes read so far
+	err error
+}
+
+func (sr *snapshotReader) read(n int) []byte {
+	b := make([]byte, n)
+	if sr.err != nil {
+		return b
+	}
+	read, err := io.ReadFull(sr.r, b)
+	sr.n += int64(read)
+	if err != nil {
+		sr.err = fmt.Errorf("unexpected end of snapshot: %w", err)
+		return b
+	}
+	sr.crc.Write(b)
+	return b
+}
+
+func (sr *snapshotReader) readByte() byte {
+	return sr.read(1)[0]
+}
+
+func (sr *snapshotReader) readUvarint() uint64 {
+	var buf []byte
+	for sr.err == nil && len(buf) < binary.MaxVarintLen64 {
+		b := sr.readByte()
+		buf = append(buf, b)
+		if b < 0x80 {
+			break
+		}
+	}
+	n, size := binary.Uvarint(buf)
+	if sr.err == nil && size <= 0 {
+		sr.err = errors.New("invalid length in snapshot")
+	}
+	return n
+}
+
+func (sr *snapshotReader) readString() string {
+	n := sr.readUvarint()
+	if sr.err == nil && n > snapshotMaxString {
+		sr.err = errors.New("invalid string length in snapshot")
+	}
+	if sr.err != nil {
+		return ""
+	}
+	return string(sr.read(int(n)))
+}
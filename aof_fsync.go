@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// appendfsync policies, from the safest to the fastest.
+const (
+	// Every write is on disk before the client gets its reply
+	FsyncAlways = "always"
+	// Writes are synced once per second, a crash loses at most one second
+	FsyncEverySec = "everysec"
+	// The OS decides when to flush, usually every 30 seconds or so on Linux
+	FsyncNo = "no"
+)
+
+// SetFsync changes the appendfsync policy. It takes effect for the next write.
+func (aof *Aof) SetFsync(policy string) error {
+	switch policy {
+	case FsyncAlways, FsyncEverySec, FsyncNo:
+	default:
+		return fmt.Errorf("invalid appendfsync policy '%s'", policy)
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	aof.fsync = policy
+	return nil
+}
+
+// Commit makes every write done so far durable when the policy is always, and
+// does nothing otherwise. It is meant to be called after Write and before the
+// client is answered, without holding any lock that other writers need: callers
+// arriving while an fsync is running wait for it and then share the next one,
+// so N concurrent writers cost far fewer than N fsyncs (group commit).
+func (aof *Aof) Commit() error {
+	aof.mu.Lock()
+	policy := aof.fsync
+	aof.mu.Unlock()
+
+	if policy != FsyncAlways {
+		return nil
+	}
+	return aof.syncAll()
+}
+
+// syncAll returns once everything written before it was called is on disk.
+func (aof *Aof) syncAll() error {
+	aof.mu.Lock()
+	target := aof.written
+	aof.mu.Unlock()
+
+	aof.syncMu.Lock()
+	defer aof.syncMu.Unlock()
+
+	for aof.synced < target {
+		// Someone else is already syncing, their fsync may cover our writes
+		// too. Either way we check again once it is done.
+		if aof.syncing {
+			aof.syncCond.Wait()
+			continue
+		}
+
+		aof.syncing = true
+		aof.mu.Lock()
+		file, upto, closed := aof.file, aof.written, aof.closed
+		aof.mu.Unlock()
+		if closed {
+			aof.syncing = false
+			aof.syncCond.Broadcast()
+			return os.ErrClosed
+		}
+
+		aof.syncMu.Unlock()
+		err := file.Sync()
+		aof.syncMu.Lock()
+
+		aof.syncing = false
+		aof.syncCond.Broadcast()
+		if errors.Is(err, os.ErrClosed) {
+			// A rewrite switched to a new incr file in the meantime. The
+			// previous one was synced first, so try again with the new one.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		aof.synced = max(aof.synced, upto)
+	}
+	return nil
+}
+
+// syncLoop is the background syncer used by the everysec policy. It stops when
+// the AOF is closed.
+func (aof *Aof) syncLoop() {
+	defer close(aof.done)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-aof.stop:
+			return
+		case <-ticker.C:
+			aof.mu.Lock()
+			policy := aof.fsync
+			aof.mu.Unlock()
+
+			if policy == FsyncEverySec {
+				if err := aof.syncAll(); err != nil {
+					fmt.Println("Error syncing the AOF:", err)
+				}
+			}
+		}
+	}
+}
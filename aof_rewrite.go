@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	appendonly "github.com/IAmRiteshKoushik/bluedis/aof"
+)
+
+var ErrRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+
+// BeginRewrite sends every write made from now on to a new incr file, which
+// will follow the base file produced by CompleteRewrite. The caller must make
+// sure no command is applied between BeginRewrite and the moment it takes the
+// copy of the dataset that will be handed to CompleteRewrite.
+func (aof *Aof) BeginRewrite() error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.rewriting {
+		return ErrRewriteInProgress
+	}
+	if err := aof.openIncr(); err != nil {
+		return err
+	}
+	aof.rewriting = true
+	aof.rewriteIncr = aof.manifest.Incrs[len(aof.manifest.Incrs)-1].Seq
+	aof.rewriteStart = time.Now()
+	return nil
+}
+
+// CompleteRewrite produces the rewritten AOF. dump is called with the new
+// base file and must write what rebuilds the dataset copied right after
+// BeginRewrite: the minimal list of commands, or a snapshot preamble. The
+// manifest then atomically switches to the new base followed by the incr
+// files written since BeginRewrite, and the files it no longer lists are
+// removed. This is meant to run in the background.
+func (aof *Aof) CompleteRewrite(dump func(w io.Writer) error) error {
+	err := aof.completeRewrite(dump)
+	if err != nil {
+		aof.AbortRewrite()
+	}
+	return err
+}
+
+// AbortRewrite gives up on a rewrite that will not complete. The incr file it
+// opened simply stays part of the AOF.
+func (aof *Aof) AbortRewrite() {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	aof.rewriting = false
+}
+
+// Rewriting reports whether a background rewrite is in progress.
+func (aof *Aof) Rewriting() bool {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	return aof.rewriting
+}
+
+// Size returns the current size of the AOF and its size after the last rewrite
+// (or at startup). Comparing the two tells how much it has grown since.
+func (aof *Aof) Size() (current, base int64) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	return aof.size, aof.baseSize
+}
+
+func (aof *Aof) completeRewrite(dump func(w io.Writer) error) error {
+	tmpPath := filepath.Join(aof.dir, fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer tmp.Close()
+
+	// The slow part, writing out the dataset, happens without holding the
+	// lock so that clients can keep appending to the incr file
+	w := bufio.NewWriter(tmp)
+	if err := dump(w); err != nil {
+		return err
+	}
+	aof.mu.Lock()
+	timestamps, start := aof.timestamps, aof.rewriteStart
+	aof.mu.Unlock()
+	if timestamps {
+		// Tells point-in-time recovery how far back the AOF now goes
+		if _, err := w.Write(appendonly.TimestampAnnotation(start.Unix())); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.closed {
+		return errors.New("AOF closed during rewrite")
+	}
+
+	seq := 1
+	if aof.manifest.Base != nil {
+		seq = aof.manifest.Base.Seq + 1
+	}
+	base := &appendonly.File{Name: fmt.Sprintf("%s.%d.base.aof", aof.name, seq), Seq: seq, Type: appendonly.FileBase}
+	if err := os.Rename(tmpPath, filepath.Join(aof.dir, base.Name)); err != nil {
+		return err
+	}
+
+	// Until the new manifest is in place the old one still lists a complete
+	// set of files, so a crash at any point loses nothing
+	m := &appendonly.Manifest{Base: base}
+	for _, incr := range aof.manifest.Incrs {
+		if incr.Seq >= aof.rewriteIncr {
+			m.Incrs = append(m.Incrs, incr)
+		}
+	}
+	if err := appendonly.WriteManifest(aof.manifestPath(), m); err != nil {
+		os.Remove(filepath.Join(aof.dir, base.Name))
+		return err
+	}
+
+	var size int64
+	for _, f := range aof.manifest.Files() {
+		if !m.Contains(f) {
+			os.Remove(filepath.Join(aof.dir, f.Name))
+		}
+	}
+	for _, f := range m.Files() {
+		if info, err := os.Stat(filepath.Join(aof.dir, f.Name)); err == nil {
+			size += info.Size()
+		}
+	}
+
+	aof.manifest = m
+	aof.size = size
+	aof.baseSize = size
+	aof.rewriting = false
+	return nil
+}
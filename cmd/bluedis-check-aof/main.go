@@ -0,0 +1,187 @@
+// Command bluedis-check-aof checks an append-only file written by Bluedis and
+// optionally fixes it by cutting off whatever follows the last valid command.
+// Given the manifest of a multi part AOF it checks every file it lists, and
+// only the last one can be fixed.
+//
+// It also cuts a valid AOF at an earlier point, for point-in-time recovery:
+// before the first command made after a unix time (this needs the timestamps
+// written with aof-timestamp-enabled), or after a number of commands. Either
+// way it tells what it is about to drop and asks before changing anything.
+//
+//	bluedis-check-aof [--fix] <file.aof|file.manifest>
+//	bluedis-check-aof --truncate-to-timestamp <unix time> <file.aof|file.manifest>
+//	bluedis-check-aof --truncate-to-command <n> <file.aof|file.manifest>
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/IAmRiteshKoushik/bluedis/aof"
+)
+
+const usage = `Usage: bluedis-check-aof [--fix] <file.aof|file.manifest>
+       bluedis-check-aof --truncate-to-timestamp <unix time> <file.aof|file.manifest>
+       bluedis-check-aof --truncate-to-command <n> <file.aof|file.manifest>`
+
+func main() {
+	fix := false
+	args := os.Args[1:]
+	if len(args) == 3 && (args[0] == "--truncate-to-timestamp" || args[0] == "--truncate-to-command") {
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || n <= 0 {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		var limit aof.ReplayLimit
+		if args[0] == "--truncate-to-timestamp" {
+			limit.Timestamp = n
+		} else {
+			limit.Commands = int(n)
+		}
+		truncateTo(args[2], limit)
+		return
+	}
+	if len(args) == 2 && args[0] == "--fix" {
+		fix = true
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	paths := []string{args[0]}
+	if strings.HasSuffix(args[0], ".manifest") {
+		var err error
+		if paths, err = aof.ManifestFiles(args[0]); err != nil {
+			fmt.Println("Cannot read the manifest", args[0]+":", err)
+			os.Exit(1)
+		}
+	}
+
+	for i, path := range paths {
+		if len(paths) > 1 {
+			fmt.Println("Checking", path)
+		}
+		if !check(path, fix, i == len(paths)-1) {
+			os.Exit(1)
+		}
+	}
+}
+
+// check checks a single file and reports whether it is valid, or was fixed.
+// Only the last file of an AOF can legitimately end with a partial command.
+func check(path string, fix, last bool) bool {
+	result, err := aof.CheckFile(path)
+	if err != nil {
+		fmt.Println("Cannot check", path+":", err)
+		return false
+	}
+
+	if result.Preamble > 0 {
+		fmt.Printf("The AOF starts with a snapshot preamble of %d bytes\n", result.Preamble)
+	}
+
+	var truncated *aof.TruncatedError
+	var corrupt *aof.CorruptError
+	switch {
+	case errors.As(result.Err, &truncated):
+		fmt.Printf("0x%x: %v\n", truncated.Offset, truncated)
+	case errors.As(result.Err, &corrupt):
+		fmt.Printf("0x%x: %v\n", corrupt.Offset, corrupt)
+	}
+
+	fmt.Printf("AOF analyzed: size=%d, ok_up_to=%d, commands=%d, diff=%d\n",
+		result.Size, result.Valid, result.Commands, result.Size-result.Valid)
+
+	if result.Err == nil {
+		fmt.Println("AOF is valid")
+		return true
+	}
+
+	// Cutting the file before the end of the preamble would drop every key
+	if result.Preamble > 0 && result.Valid == 0 {
+		fmt.Println("The snapshot preamble is damaged, this can't be fixed by truncating the AOF.")
+		return false
+	}
+
+	// Cutting a file in the middle of the AOF would lose the commands of
+	// that file while keeping those of the files after it
+	if !last {
+		fmt.Println("Only the last file of a multi part AOF can be fixed by truncating it.")
+		return false
+	}
+
+	if !fix {
+		fmt.Println("AOF is not valid. Use the --fix option to try fixing it.")
+		return false
+	}
+
+	fmt.Printf("This will shrink the AOF from %d bytes, with %d bytes, to %d bytes\n",
+		result.Size, result.Size-result.Valid, result.Valid)
+	if !confirm() {
+		return false
+	}
+
+	if err := aof.TruncateFile(path, result.Valid); err != nil {
+		fmt.Println("Failed to truncate AOF:", err)
+		return false
+	}
+	fmt.Println("Successfully truncated AOF")
+	return true
+}
+
+// confirm asks whether to go on, and reports whether the answer was yes.
+func confirm() bool {
+	fmt.Print("Continue? [y/N]: ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if !strings.HasPrefix(strings.ToLower(answer), "y") {
+		fmt.Println("Aborting...")
+		return false
+	}
+	return true
+}
+
+// truncateTo cuts the AOF at path at the point given by limit, once told what
+// that drops.
+func truncateTo(path string, limit aof.ReplayLimit) {
+	t, err := aof.PlanTruncation(path, limit)
+	if errors.Is(err, aof.ErrNoTimestamps) {
+		fmt.Println("The AOF has no timestamp annotations, timestamps are not enabled " +
+			"(aof-timestamp-enabled is no). It can't be truncated to a time.")
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Println("Cannot truncate", path+":", err)
+		os.Exit(1)
+	}
+	if len(t.Cuts) == 0 {
+		fmt.Printf("The whole AOF is before the recovery point, nothing to truncate (%d commands)\n", t.Kept)
+		return
+	}
+
+	fmt.Println("This will drop:")
+	for _, cut := range t.Cuts {
+		if cut.Remove {
+			fmt.Printf("  %s: the whole file, %d bytes\n", cut.Path, cut.Size)
+		} else {
+			fmt.Printf("  %s: %d bytes from offset 0x%x to the end, keeping %d bytes\n",
+				cut.Path, cut.Size-cut.Offset, cut.Offset, cut.Offset)
+		}
+	}
+	fmt.Printf("%d commands will be left\n", t.Kept)
+	if !confirm() {
+		os.Exit(1)
+	}
+
+	if err := t.Apply(); err != nil {
+		fmt.Println("Failed to truncate AOF:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Successfully truncated AOF, %d commands left\n", t.Kept)
+}
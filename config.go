@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// Config holds the server settings. They are read from an optional config file
+// and the command line at startup (e.g. `./bluedis bluedis.conf --port 6380`),
+// and the mutable ones can be changed at runtime with CONFIG SET.
+type Config struct {
+	mu sync.RWMutex
+
+	port                     int
+	databases                int
+	dbFilename               string
+	snapshotFormat           string
+	saveRules                []saveRule
+	appendOnly               bool
+	appendFilename           string
+	appendDirname            string
+	appendFsync              string
+	autoAofRewritePercentage int64
+	autoAofRewriteMinSize    int64
+	aofLoadTruncated         bool
+	aofUseRDBPreamble        bool
+	aofTimestampEnabled      bool
+
+	// Called with the new value after a parameter changed
+	observers map[string][]func(value string)
+}
+
+var config = &Config{
+	port:                     6379,
+	databases:                16,
+	dbFilename:               "dump.bdb",
+	snapshotFormat:           snapshotFormatBluedis,
+	saveRules:                []saveRule{{3600, 1}, {300, 100}, {60, 10000}},
+	appendOnly:               true,
+	appendFilename:           "database.aof",
+	appendDirname:            "appendonlydir",
+	appendFsync:              FsyncEverySec,
+	autoAofRewritePercentage: 100,
+	autoAofRewriteMinSize:    64 * 1024 * 1024,
+	aofLoadTruncated:         true,
+	aofUseRDBPreamble:        true,
+}
+
+// saveRule triggers a background save once at least changes write commands
+// were executed and seconds have passed since the last save.
+type saveRule struct {
+	seconds int
+	changes int
+}
+
+type configParam struct {
+	get func(c *Config) string
+	set func(c *Config, value string) error
+	// Immutable parameters can only be given at startup
+	immutable bool
+}
+
+// Every parameter is read and written with the config lock already held.
+var configParams = map[string]configParam{
+	"port": {
+		get: func(c *Config) string { return strconv.Itoa(c.port) },
+		set: func(c *Config, value string) error {
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 0 || port > 65535 {
+				return fmt.Errorf("argument must be between 0 and 65535 inclusive")
+			}
+			c.port = port
+			return nil
+		},
+		immutable: true,
+	},
+	"databases": {
+		get: func(c *Config) string { return strconv.Itoa(c.databases) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > math.MaxInt32 {
+				return fmt.Errorf("argument must be between 1 and %d inclusive", math.MaxInt32)
+			}
+			c.databases = n
+			return nil
+		},
+		immutable: true,
+	},
+	"dbfilename": {
+		get: func(c *Config) string { return c.dbFilename },
+		set: func(c *Config, value string) error {
+			if value == "" || strings.ContainsRune(value, '/') {
+				return fmt.Errorf("dbfilename can't be a path, just a filename")
+			}
+			c.dbFilename = value
+			return nil
+		},
+	},
+	"snapshot-format": {
+		get: func(c *Config) string { return c.snapshotFormat },
+		set: func(c *Config, value string) error {
+			switch value = strings.ToLower(value); value {
+			case snapshotFormatBluedis, snapshotFormatRedis:
+				c.snapshotFormat = value
+				return nil
+			}
+			return fmt.Errorf("argument must be one of the following: bluedis, redis")
+		},
+	},
+	"save": {
+		get: func(c *Config) string {
+			parts := make([]string, 0, 2*len(c.saveRules))
+			for _, rule := range c.saveRules {
+				parts = append(parts, strconv.Itoa(rule.seconds), strconv.Itoa(rule.changes))
+			}
+			return strings.Join(parts, " ")
+		},
+		set: func(c *Config, value string) error {
+			fields := strings.Fields(value)
+			if len(fields)%2 != 0 {
+				return fmt.Errorf("save rules come in pairs of <seconds> <changes>")
+			}
+			rules := make([]saveRule, 0, len(fields)/2)
+			for i := 0; i < len(fields); i += 2 {
+				seconds, err1 := strconv.Atoi(fields[i])
+				changes, err2 := strconv.Atoi(fields[i+1])
+				if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+					return fmt.Errorf("invalid save rule '%s %s'", fields[i], fields[i+1])
+				}
+				rules = append(rules, saveRule{seconds, changes})
+			}
+			c.saveRules = rules
+			return nil
+		},
+	},
+	"appendonly": {
+		get: func(c *Config) string { return formatBool(c.appendOnly) },
+		set: func(c *Config, value string) (err error) {
+			c.appendOnly, err = parseBool(value)
+			return err
+		},
+		immutable: true,
+	},
+	"appendfilename": {
+		get: func(c *Config) string { return c.appendFilename },
+		set: func(c *Config, value string) error {
+			if value == "" || strings.ContainsRune(value, '/') {
+				return fmt.Errorf("appendfilename can't be a path, just a filename")
+			}
+			c.appendFilename = value
+			return nil
+		},
+		immutable: true,
+	},
+	"appenddirname": {
+		get: func(c *Config) string { return c.appendDirname },
+		set: func(c *Config, value string) error {
+			if value == "" || strings.ContainsRune(value, '/') {
+				return fmt.Errorf("appenddirname can't be a path, just a directory name")
+			}
+			c.appendDirname = value
+			return nil
+		},
+		immutable: true,
+	},
+	"appendfsync": {
+		get: func(c *Config) string { return c.appendFsync },
+		set: func(c *Config, value string) error {
+			value = strings.ToLower(value)
+			if value != FsyncAlways && value != FsyncEverySec && value != FsyncNo {
+				return fmt.Errorf("argument must be one of the following: always, everysec, no")
+			}
+			c.appendFsync = value
+			return nil
+		},
+	},
+	"auto-aof-rewrite-percentage": {
+		get: func(c *Config) string { return strconv.FormatInt(c.autoAofRewritePercentage, 10) },
+		set: func(c *Config, value string) error {
+			perc, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || perc < 0 {
+				return fmt.Errorf("argument must be a non-negative integer")
+			}
+			c.autoAofRewritePercentage = perc
+			return nil
+		},
+	},
+	"auto-aof-rewrite-min-size": {
+		get: func(c *Config) string { return strconv.FormatInt(c.autoAofRewriteMinSize, 10) },
+		set: func(c *Config, value string) error {
+			size, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			c.autoAofRewriteMinSize = size
+			return nil
+		},
+	},
+	"aof-load-truncated": {
+		get: func(c *Config) string { return formatBool(c.aofLoadTruncated) },
+		set: func(c *Config, value string) (err error) {
+			c.aofLoadTruncated, err = parseBool(value)
+			return err
+		},
+	},
+	"aof-timestamp-enabled": {
+		get: func(c *Config) string { return formatBool(c.aofTimestampEnabled) },
+		set: func(c *Config, value string) (err error) {
+			c.aofTimestampEnabled, err = parseBool(value)
+			return err
+		},
+	},
+	"aof-use-rdb-preamble": {
+		get: func(c *Config) string { return formatBool(c.aofUseRDBPreamble) },
+		set: func(c *Config, value string) (err error) {
+			c.aofUseRDBPreamble, err = parseBool(value)
+			return err
+		},
+	},
+}
+
+// Load applies the command line arguments. The first one may be the path
+// of a config file with one "name value" directive per line, the rest are
+// "--name value" pairs that override it.
+func (c *Config) Load(args []string) error {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+		if err := c.loadFile(args[0]); err != nil {
+			return err
+		}
+		args = args[1:]
+	}
+
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "--") || i+1 >= len(args) {
+			return fmt.Errorf("Bad directive or wrong number of arguments: '%s'", args[i])
+		}
+		if err := c.Set(strings.TrimPrefix(args[i], "--"), args[i+1], true); err != nil {
+			return err
+		}
+		i++
+	}
+	return nil
+}
+
+func (c *Config) loadFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		// Everything after the name is the value, e.g. save 3600 1 300 100
+		fields, err := resp.SplitInlineArgs(text)
+		if err != nil || len(fields) < 2 {
+			return fmt.Errorf("%s:%d: Bad directive or wrong number of arguments", name, line)
+		}
+		if err := c.Set(fields[0], strings.Join(fields[1:], " "), true); err != nil {
+			return fmt.Errorf("%s:%d: %v", name, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Set changes a parameter. Immutable ones are only accepted at startup.
+func (c *Config) Set(name, value string, startup bool) error {
+	param, ok := configParams[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("Unknown option or number of arguments for CONFIG SET - '%s'", name)
+	}
+	if param.immutable && !startup {
+		return fmt.Errorf("can't set immutable config '%s'", name)
+	}
+
+	c.mu.Lock()
+	if err := param.set(c, value); err != nil {
+		c.mu.Unlock()
+		return fmt.Errorf("Invalid argument '%s' for CONFIG SET '%s' - %v", value, name, err)
+	}
+	name = strings.ToLower(name)
+	value = param.get(c)
+	observers := c.observers[name]
+	c.mu.Unlock()
+
+	for _, fn := range observers {
+		fn(value)
+	}
+	return nil
+}
+
+// OnChange registers fn to be called with the new value every time the
+// parameter is set, so that components created from the config at startup
+// (like the AOF) can follow CONFIG SET.
+func (c *Config) OnChange(name string, fn func(value string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.observers == nil {
+		c.observers = make(map[string][]func(value string))
+	}
+	c.observers[name] = append(c.observers[name], fn)
+}
+
+// Get returns every parameter whose name matches one of the glob patterns,
+// as name/value pairs sorted by name.
+func (c *Config) Get(patterns ...string) []string {
+	var names []string
+	for name := range configParams {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	pairs := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		pairs = append(pairs, name, configParams[name].get(c))
+	}
+	return pairs
+}
+
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("argument must be 'yes' or 'no'")
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// parseMemory parses a size in bytes with an optional unit, the same way
+// Redis config files do: 1k = 1000, 1kb = 1024, and so on for m and g.
+func parseMemory(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+
+	lower := strings.ToLower(value)
+	mul := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower, mul = strings.TrimSuffix(lower, unit.suffix), unit.mul
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("argument must be a memory value")
+	}
+	return n * mul, nil
+}
+
+// configHandler implements CONFIG GET and CONFIG SET.
+func configHandler(client *Client, args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'config' command"}
+	}
+
+	switch strings.ToUpper(args[0].Bulk) {
+	case "GET":
+		if len(args) < 2 {
+			return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'config|get' command"}
+		}
+		patterns := make([]string, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			patterns = append(patterns, arg.Bulk)
+		}
+		pairs := config.Get(patterns...)
+		result := make([]resp.Value, len(pairs))
+		for i, s := range pairs {
+			result[i] = resp.Value{Typ: "bulk", Bulk: s}
+		}
+		return resp.Value{Typ: "map", Array: result}
+	case "SET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'config|set' command"}
+		}
+		for i := 1; i < len(args); i += 2 {
+			if err := config.Set(args[i].Bulk, args[i+1].Bulk, false); err != nil {
+				return resp.Value{Typ: "error", Str: "ERR " + err.Error()}
+			}
+		}
+		return resp.Value{Typ: "string", Str: "OK"}
+	default:
+		return resp.Value{Typ: "error", Str: fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", args[0].Bulk)}
+	}
+}
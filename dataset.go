@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// Dataset is a point-in-time copy of every key of every database. Background
+// persistence works on a copy so that it can take its time writing it out
+// while clients keep changing the live databases.
+type Dataset struct {
+	dbs map[int]map[string]*Object // Keys by database, empty ones left out
+}
+
+func newDataset() *Dataset {
+	return &Dataset{dbs: make(map[int]map[string]*Object)}
+}
+
+// db returns the keys of database i, to be read or filled.
+func (ds *Dataset) db(i int) map[string]*Object {
+	keys, ok := ds.dbs[i]
+	if !ok {
+		keys = make(map[string]*Object)
+		ds.dbs[i] = keys
+	}
+	return keys
+}
+
+// indexes returns the index of every database that has keys, in order.
+func (ds *Dataset) indexes() []int {
+	var indexes []int
+	for i, keys := range ds.dbs {
+		if len(keys) > 0 {
+			indexes = append(indexes, i)
+		}
+	}
+	slices.Sort(indexes)
+	return indexes
+}
+
+// copyDataset copies the whole dataset. The caller must hold writeMu so that
+// no write command is half applied while the copy is taken.
+func copyDataset() *Dataset {
+	ds := newDataset()
+
+	now := time.Now()
+	keyspaceMu.RLock()
+	for _, db := range databases {
+		if db.len() > 0 {
+			copyKeys(ds.db(db.id), db, now)
+		}
+	}
+	keyspaceMu.RUnlock()
+
+	return ds
+}
+
+// copyKeys copies the keys of db to keys.
+func copyKeys(keys map[string]*Object, db *Keyspace, now time.Time) {
+	for key, obj := range db.all() {
+		// Keys that already expired but were not accessed since are dropped,
+		// and so are hashes all the fields of which expired
+		if obj.expired(now) {
+			continue
+		}
+		dup := obj.copy()
+		if dup.Type == typeHash && dup.Hash.len() == 0 {
+			continue
+		}
+		keys[key] = dup
+	}
+}
+
+// Number of list elements pushed per RPUSH in a rewritten AOF, so that a huge
+// list does not turn into a single huge command.
+const rewriteItemsPerCommand = 64
+
+// rewriteCommands writes the shortest list of commands that rebuilds the
+// dataset to w, used as the content of a rewritten AOF. The keys of every
+// database follow a SELECT of that database.
+func (ds *Dataset) rewriteCommands(w io.Writer) error {
+	for _, i := range ds.indexes() {
+		if _, err := w.Write(selectValue(i).Marshal()); err != nil {
+			return err
+		}
+		if err := rewriteKeys(w, ds.dbs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rewriteKeys(w io.Writer, keys map[string]*Object) error {
+	bulk := func(s string) resp.Value { return resp.Value{Typ: "bulk", Bulk: s} }
+	emit := func(value resp.Value) error {
+		_, err := w.Write(value.Marshal())
+		return err
+	}
+
+	for key, obj := range keys {
+		switch obj.Type {
+		case typeString:
+			if err := emit(commandValue("SET", bulk(key), bulk(obj.Content))); err != nil {
+				return err
+			}
+		case typeHash:
+			for field, value := range obj.Hash.all() {
+				if err := emit(commandValue("HSET", bulk(key), bulk(field), bulk(value))); err != nil {
+					return err
+				}
+			}
+			for field, deadline := range obj.FieldExpires {
+				ms := strconv.FormatInt(deadline.UnixMilli(), 10)
+				if err := emit(commandValue("HPEXPIREAT", bulk(key), bulk(ms), bulk("FIELDS"), bulk("1"), bulk(field))); err != nil {
+					return err
+				}
+			}
+		case typeList:
+			elements := obj.elements()
+			for start := 0; start < len(elements); start += rewriteItemsPerCommand {
+				end := min(start+rewriteItemsPerCommand, len(elements))
+				args := []resp.Value{bulk(key)}
+				for _, element := range elements[start:end] {
+					args = append(args, bulk(element))
+				}
+				if err := emit(commandValue("RPUSH", args...)); err != nil {
+					return err
+				}
+			}
+		}
+		if obj.HasExpiry {
+			if err := emit(expireValue(key, obj.Begone)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// restore replaces the live dataset with the content of ds. It is only used at
+// startup, before any client can connect. It fails when ds has keys in a
+// database beyond the configured ones.
+func (ds *Dataset) restore() error {
+	for _, i := range ds.indexes() {
+		if i >= len(databases) {
+			return fmt.Errorf("the data has keys in database %d but only %d databases are configured", i, len(databases))
+		}
+	}
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	for _, db := range databases {
+		db.flush()
+		for key, obj := range ds.dbs[db.id] {
+			db.set(key, obj)
+		}
+	}
+	return nil
+}
+
+// size returns the number of keys in the dataset.
+func (ds *Dataset) size() int {
+	n := 0
+	for _, keys := range ds.dbs {
+		n += len(keys)
+	}
+	return n
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// Commands that deal with the numbered databases as a whole. Every connection
+// starts on database 0 and SELECT moves it to another one; the other commands
+// act on the selected database unless they take indexes.
+
+// parseDB parses the index of a database.
+func parseDB(arg resp.Value) (int, *resp.Value) {
+	index, err := strconv.Atoi(arg.Bulk)
+	if err != nil {
+		return 0, &resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	if index < 0 || index >= len(databases) {
+		return 0, &resp.Value{Typ: "error", Str: "ERR DB index is out of range"}
+	}
+	return index, nil
+}
+
+// selectHandler implements SELECT index. It is not logged to the AOF as
+// such: the AOF selects the database of each write command before it when
+// needed (see Aof.WriteDB).
+func selectHandler(client *Client, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'select' command"}
+	}
+	index, errValue := parseDB(args[0])
+	if errValue != nil {
+		return *errValue
+	}
+	client.db = index
+	return resp.Value{Typ: "string", Str: "OK"}
+}
+
+// move implements MOVE key db. The key keeps its deadline, and is only moved
+// when the other database does not have it yet.
+func move(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'move' command"}
+	}
+	index, errValue := parseDB(args[1])
+	if errValue != nil {
+		return *errValue
+	}
+	if index == db.id {
+		return resp.Value{Typ: "error", Str: "ERR source and destination objects are the same"}
+	}
+
+	key := args[0].Bulk
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	obj := db.lookupKeyWrite(key)
+	dst := databases[index]
+	if obj == nil || dst.lookupKeyWrite(key) != nil {
+		return resp.Value{Typ: "integer", Num: 0}
+	}
+	db.delete(key)
+	dst.set(key, obj)
+	return resp.Value{Typ: "integer", Num: 1}
+}
+
+// swapdb implements SWAPDB index1 index2. Clients that selected one of the
+// databases see the keys of the other one from then on.
+func swapdb(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'swapdb' command"}
+	}
+	first, err1 := strconv.Atoi(args[0].Bulk)
+	if err1 != nil {
+		return resp.Value{Typ: "error", Str: "ERR invalid first DB index"}
+	}
+	second, err2 := strconv.Atoi(args[1].Bulk)
+	if err2 != nil {
+		return resp.Value{Typ: "error", Str: "ERR invalid second DB index"}
+	}
+	if first < 0 || first >= len(databases) || second < 0 || second >= len(databases) {
+		return resp.Value{Typ: "error", Str: "ERR DB index is out of range"}
+	}
+
+	keyspaceMu.Lock()
+	databases[first].swap(databases[second])
+	keyspaceMu.Unlock()
+	return resp.Value{Typ: "string", Str: "OK"}
+}
+
+// dbsize implements DBSIZE, the number of keys in the selected database.
+// Keys that expired but were not reclaimed yet are counted.
+func dbsize(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 0 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'dbsize' command"}
+	}
+	keyspaceMu.RLock()
+	defer keyspaceMu.RUnlock()
+	return resp.Value{Typ: "integer", Num: db.len()}
+}
+
+// parseFlushMode checks the optional ASYNC or SYNC argument of FLUSHDB and
+// FLUSHALL. Both are accepted and do the same: the keys are dropped at once
+// and their memory is left to the garbage collector either way.
+func parseFlushMode(name string, args []resp.Value) *resp.Value {
+	if len(args) > 1 {
+		return &resp.Value{Typ: "error", Str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
+	if len(args) == 1 {
+		if mode := strings.ToUpper(args[0].Bulk); mode != "ASYNC" && mode != "SYNC" {
+			return &resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+	}
+	return nil
+}
+
+// flushdb implements FLUSHDB [ASYNC|SYNC], removing every key of the selected
+// database.
+func flushdb(db *Keyspace, args []resp.Value) resp.Value {
+	if errValue := parseFlushMode("flushdb", args); errValue != nil {
+		return *errValue
+	}
+	keyspaceMu.Lock()
+	db.flush()
+	keyspaceMu.Unlock()
+	return resp.Value{Typ: "string", Str: "OK"}
+}
+
+// flushall implements FLUSHALL [ASYNC|SYNC], removing every key of every
+// database.
+func flushall(db *Keyspace, args []resp.Value) resp.Value {
+	if errValue := parseFlushMode("flushall", args); errValue != nil {
+		return *errValue
+	}
+	keyspaceMu.Lock()
+	for _, ks := range databases {
+		ks.flush()
+	}
+	keyspaceMu.Unlock()
+	return resp.Value{Typ: "string", Str: "OK"}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+func TestMove(t *testing.T) {
+	initDatabases(4)
+	src, dst := databases[0], databases[1]
+	command(src, "SET", "key", "v", "EX", "100")
+	command(src, "SET", "taken", "v")
+	command(dst, "SET", "taken", "other")
+	command(src, "SET", "expired", "v", "PX", "1")
+	time.Sleep(10 * time.Millisecond)
+	defer takeExpiredKeys()
+
+	wantInteger(t, command(src, "MOVE", "key", "1"), 1, "MOVE key 1")
+	wantInteger(t, command(src, "EXISTS", "key"), 0, "EXISTS key in 0")
+	wantInteger(t, command(dst, "TTL", "key"), 100, "TTL key in 1")
+	if obj, _ := src.expires.get("key"); obj != nil {
+		t.Errorf("key still has a deadline in 0")
+	}
+	if obj, _ := dst.expires.get("key"); obj == nil {
+		t.Errorf("key has no deadline in 1")
+	}
+
+	wantInteger(t, command(src, "MOVE", "taken", "1"), 0, "MOVE taken 1")
+	wantReply(t, command(dst, "GET", "taken"), resp.Value{Typ: "bulk", Bulk: "other"}, "GET taken in 1")
+	wantInteger(t, command(src, "MOVE", "expired", "1"), 0, "MOVE expired 1")
+	wantInteger(t, command(src, "MOVE", "missing", "1"), 0, "MOVE missing 1")
+	wantReply(t, command(src, "MOVE", "taken", "0"), resp.Value{Typ: "error", Str: "ERR source and destination objects are the same"}, "MOVE taken 0")
+	wantReply(t, command(src, "MOVE", "taken", "4"), resp.Value{Typ: "error", Str: "ERR DB index is out of range"}, "MOVE taken 4")
+
+	// The target index means the same when replaying, so MOVE is logged as
+	// it was sent
+	command(dst, "DEL", "key")
+	command(src, "SET", "key", "v")
+	if got := logged(src, "MOVE", "key", "1"); !slices.Equal(got, []string{"MOVE key 1"}) {
+		t.Errorf("MOVE logged %q", got)
+	}
+	if got := logged(src, "MOVE", "key", "1"); got != nil {
+		t.Errorf("a MOVE that did nothing logged %q", got)
+	}
+}
+
+func TestSwapdbFlushdb(t *testing.T) {
+	initDatabases(4)
+	command(databases[0], "SET", "a", "v", "EX", "100")
+	command(databases[2], "SET", "b", "v")
+	command(databases[2], "SET", "c", "v", "EX", "200")
+
+	wantReply(t, command(databases[0], "SWAPDB", "0", "2"), resp.Value{Typ: "string", Str: "OK"}, "SWAPDB 0 2")
+	wantInteger(t, command(databases[0], "DBSIZE"), 2, "DBSIZE 0")
+	wantInteger(t, command(databases[0], "TTL", "c"), 200, "TTL c in 0")
+	wantInteger(t, command(databases[2], "TTL", "a"), 100, "TTL a in 2")
+	if databases[0].id != 0 || databases[2].id != 2 {
+		t.Errorf("the databases swapped indexes")
+	}
+	wantReply(t, command(databases[0], "SWAPDB", "0", "x"), resp.Value{Typ: "error", Str: "ERR invalid second DB index"}, "SWAPDB 0 x")
+
+	wantReply(t, command(databases[0], "FLUSHDB", "ASYNC"), resp.Value{Typ: "string", Str: "OK"}, "FLUSHDB")
+	if databases[0].len() != 0 || databases[0].expires.len() != 0 {
+		t.Errorf("%d keys and %d deadlines left after FLUSHDB", databases[0].len(), databases[0].expires.len())
+	}
+	wantInteger(t, command(databases[2], "EXISTS", "a"), 1, "EXISTS a in 2")
+	wantReply(t, command(databases[0], "FLUSHDB", "NOW"), resp.Value{Typ: "error", Str: "ERR syntax error"}, "FLUSHDB NOW")
+
+	command(databases[1], "SET", "d", "v", "EX", "100")
+	command(databases[0], "FLUSHALL")
+	for _, db := range databases {
+		if db.len() != 0 || db.expires.len() != 0 {
+			t.Errorf("database %d has %d keys and %d deadlines after FLUSHALL", db.id, db.len(), db.expires.len())
+		}
+	}
+}
+
+// Every incr file selects its database first, and again whenever a write is
+// for another one.
+func TestAofSelect(t *testing.T) {
+	aof, err := NewAof(t.TempDir(), "appendonly.aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aof.Close()
+
+	set := func(key string) resp.Value {
+		return commandValue("SET", bulks(key, "v")...)
+	}
+	aof.WriteDB(0, set("a"))
+	aof.WriteDB(0, set("b"))
+	aof.WriteDB(3, set("c"), set("d"))
+	aof.WriteDB(0, set("e"))
+	aof.mu.Lock()
+	err = aof.openIncr()
+	aof.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof.WriteDB(0, set("f"))
+
+	var got []string
+	err = aof.Read(func(value resp.Value) {
+		var words []string
+		for _, arg := range value.Array {
+			words = append(words, arg.Bulk)
+		}
+		got = append(got, strings.Join(words, " "))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"SELECT 0", "SET a v", "SET b v",
+		"SELECT 3", "SET c v", "SET d v",
+		"SELECT 0", "SET e v",
+		"SELECT 0", "SET f v",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("the AOF holds %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"hash/maphash"
+	"iter"
+	"math/bits"
+	"math/rand/v2"
+)
+
+// dict is a hash table with string keys laid out like the one of Redis: a
+// power of two number of buckets, each holding a chain of entries. Unlike a Go
+// map it tells which bucket a key lives in, which is what lets SCAN walk it
+// with a cursor that stays valid while keys are added and removed between
+// calls (see scan).
+//
+// The table doubles once it holds more entries than buckets and shrinks once
+// less than a tenth of the buckets are used. Resizing moves every entry at
+// once, there is no incremental rehashing.
+type dict[V any] struct {
+	table []*dictEntry[V]
+	used  int
+	seed  maphash.Seed
+}
+
+type dictEntry[V any] struct {
+	key   string
+	value V
+	next  *dictEntry[V]
+}
+
+const dictMinSize = 4
+
+func newDict[V any]() *dict[V] {
+	return &dict[V]{
+		table: make([]*dictEntry[V], dictMinSize),
+		seed:  maphash.MakeSeed(),
+	}
+}
+
+func (d *dict[V]) bucket(key string, size int) uint64 {
+	return maphash.String(d.seed, key) & uint64(size-1)
+}
+
+func (d *dict[V]) get(key string) (V, bool) {
+	for e := d.table[d.bucket(key, len(d.table))]; e != nil; e = e.next {
+		if e.key == key {
+			return e.value, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+// set adds key or replaces its value.
+func (d *dict[V]) set(key string, value V) {
+	b := d.bucket(key, len(d.table))
+	for e := d.table[b]; e != nil; e = e.next {
+		if e.key == key {
+			e.value = value
+			return
+		}
+	}
+	d.table[b] = &dictEntry[V]{key: key, value: value, next: d.table[b]}
+	d.used++
+	if d.used > len(d.table) {
+		d.resize(2 * len(d.table))
+	}
+}
+
+// delete removes key and reports whether it was there.
+func (d *dict[V]) delete(key string) bool {
+	for p := &d.table[d.bucket(key, len(d.table))]; *p != nil; p = &(*p).next {
+		if (*p).key == key {
+			*p = (*p).next
+			d.used--
+			if len(d.table) > dictMinSize && d.used*10 < len(d.table) {
+				d.resize(d.used)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (d *dict[V]) len() int {
+	return d.used
+}
+
+// random returns an entry picked at random, false when the dict is empty.
+// Entries alone in their bucket are a little more likely to be picked than
+// the others, which is good enough for sampling.
+func (d *dict[V]) random() (string, V, bool) {
+	if d.used == 0 {
+		var zero V
+		return "", zero, false
+	}
+
+	var e *dictEntry[V]
+	for e == nil {
+		e = d.table[rand.IntN(len(d.table))]
+	}
+	n := 0
+	for chained := e; chained != nil; chained = chained.next {
+		n++
+	}
+	for i := rand.IntN(n); i > 0; i-- {
+		e = e.next
+	}
+	return e.key, e.value, true
+}
+
+// resize moves every entry to a table of at least size buckets. The entries
+// are copied rather than relinked so that an iteration started before keeps
+// going over the old table undisturbed.
+func (d *dict[V]) resize(size int) {
+	n := dictMinSize
+	for n < size {
+		n *= 2
+	}
+	table := make([]*dictEntry[V], n)
+	for _, e := range d.table {
+		for ; e != nil; e = e.next {
+			b := d.bucket(e.key, n)
+			table[b] = &dictEntry[V]{key: e.key, value: e.value, next: table[b]}
+		}
+	}
+	d.table = table
+}
+
+// all iterates over every entry. The current entry can be deleted during the
+// iteration; other changes may or may not be seen by it.
+func (d *dict[V]) all() iter.Seq2[string, V] {
+	return func(yield func(string, V) bool) {
+		for _, e := range d.table {
+			for e != nil {
+				next := e.next
+				if !yield(e.key, e.value) {
+					return
+				}
+				e = next
+			}
+		}
+	}
+}
+
+// scan calls fn for every entry of the bucket the cursor points to and returns
+// the cursor of the next bucket to visit, 0 once the walk started from cursor
+// 0 is complete. fn must not change the dict.
+//
+// This is the algorithm of Redis: the cursor is incremented starting from its
+// most significant bit rather than the least significant one. When the table
+// doubles, the buckets a visited bucket is split into are all ordered before
+// the new cursor, and when it shrinks a bucket is merged with others that come
+// after it, so every key present during the whole walk is returned at least
+// once. Keys can be returned twice after the table shrinks.
+func (d *dict[V]) scan(cursor uint64, fn func(key string, value V)) uint64 {
+	mask := uint64(len(d.table) - 1)
+	for e := d.table[cursor&mask]; e != nil; e = e.next {
+		fn(e.key, e.value)
+	}
+
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// scanWhile walks d with scan, calling between before every call. It returns
+// how many times each key was seen.
+func scanWhile(d *dict[int], between func(step int)) map[string]int {
+	seen := make(map[string]int)
+	cursor := uint64(0)
+	for step := 0; ; step++ {
+		between(step)
+		cursor = d.scan(cursor, func(key string, _ int) {
+			seen[key]++
+		})
+		if cursor == 0 {
+			return seen
+		}
+	}
+}
+
+func TestDictScan(t *testing.T) {
+	d := newDict[int]()
+	for i := range 1000 {
+		d.set(fmt.Sprint(i), i)
+	}
+	seen := scanWhile(d, func(int) {})
+	if len(seen) != 1000 {
+		t.Errorf("saw %d keys, want 1000", len(seen))
+	}
+	for key, n := range seen {
+		if n != 1 {
+			t.Errorf("saw %q %d times without any change to the dict", key, n)
+		}
+	}
+}
+
+// Keys that stay in the dict for the whole walk must be returned however much
+// it grows and shrinks in between.
+func TestDictScanResize(t *testing.T) {
+	for round := range 20 {
+		d := newDict[int]()
+		for i := range 100 {
+			d.set(fmt.Sprintf("stable:%d", i), i)
+		}
+		startSize := len(d.table)
+		maxSize, minSize := startSize, startSize
+
+		temp := 0
+		seen := scanWhile(d, func(step int) {
+			// Grow to a few thousand keys, then shrink back below the start
+			switch {
+			case step < 60:
+				for range 50 {
+					d.set(fmt.Sprintf("temp:%d", temp), temp)
+					temp++
+				}
+			case temp > 0:
+				for range 100 {
+					if temp > 0 {
+						temp--
+						d.delete(fmt.Sprintf("temp:%d", temp))
+					}
+				}
+			case step%3 == 0 && d.len() > 10:
+				// Lose some stable keys too, they need not be returned
+				for i := range 100 {
+					if d.delete(fmt.Sprintf("stable:%d", i)) {
+						break
+					}
+				}
+			}
+			maxSize = max(maxSize, len(d.table))
+			minSize = min(minSize, len(d.table))
+		})
+
+		if maxSize <= startSize || minSize >= startSize {
+			t.Fatalf("round %d: the table went from %d buckets to %d and back to %d, want it to grow and shrink",
+				round, startSize, maxSize, minSize)
+		}
+		for i := range 100 {
+			key := fmt.Sprintf("stable:%d", i)
+			if _, ok := d.get(key); ok && seen[key] == 0 {
+				t.Errorf("round %d: %q was never returned", round, key)
+			}
+		}
+	}
+}
+
+func TestDictScanEmpty(t *testing.T) {
+	d := newDict[int]()
+	calls := 0
+	seen := scanWhile(d, func(int) { calls++ })
+	if len(seen) != 0 || calls != dictMinSize {
+		t.Errorf("saw %d keys in %d calls, want none in %d", len(seen), calls, dictMinSize)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// Commands that set, read and remove the deadline of a key. Whatever command
+// sets it, the deadline is logged to the AOF as an absolute PEXPIREAT, so
+// replaying it later never extends the lifetime of a key.
+
+func expireHandler(db *Keyspace, args []resp.Value) resp.Value {
+	return expireCommand(db, "expire", args, time.Second, false)
+}
+
+func pexpire(db *Keyspace, args []resp.Value) resp.Value {
+	return expireCommand(db, "pexpire", args, time.Millisecond, false)
+}
+
+func expireat(db *Keyspace, args []resp.Value) resp.Value {
+	return expireCommand(db, "expireat", args, time.Second, true)
+}
+
+func pexpireat(db *Keyspace, args []resp.Value) resp.Value {
+	return expireCommand(db, "pexpireat", args, time.Millisecond, true)
+}
+
+// expireCondition holds the NX, XX, GT and LT flags of the EXPIRE family.
+type expireCondition struct {
+	nx, xx, gt, lt bool
+}
+
+// expireCommand implements the EXPIRE family: a key, a time given in unit,
+// either relative to now or a unix time when absolute is set, then any of the
+// condition flags.
+func expireCommand(db *Keyspace, name string, args []resp.Value, unit time.Duration, absolute bool) resp.Value {
+	if len(args) < 2 {
+		return resp.Value{
+			Typ: "error",
+			Str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name),
+		}
+	}
+
+	cond, errValue := parseExpireCondition(args[2:])
+	if errValue != nil {
+		return *errValue
+	}
+
+	key := args[0].Bulk
+	when, err := strconv.ParseInt(args[1].Bulk, 10, 64)
+	if err != nil {
+		return resp.Value{
+			Typ: "error",
+			Str: "ERR value is not an integer or out of range",
+		}
+	}
+
+	// The deadline is kept in milliseconds, it has to fit in that unit
+	invalid := resp.Value{Typ: "error", Str: fmt.Sprintf("ERR invalid expire time in '%s' command", name)}
+	factor := int64(unit / time.Millisecond)
+	if when > math.MaxInt64/factor || when < math.MinInt64/factor {
+		return invalid
+	}
+	ms := when * factor
+	if !absolute {
+		now := time.Now().UnixMilli()
+		if ms > math.MaxInt64-now {
+			return invalid
+		}
+		ms += now
+	}
+
+	return expireAt(db, key, time.UnixMilli(ms), cond)
+}
+
+// parseExpireCondition parses the flags that follow the time in the EXPIRE
+// family. They can be combined, as long as they do not contradict each other.
+func parseExpireCondition(args []resp.Value) (expireCondition, *resp.Value) {
+	var cond expireCondition
+	for _, arg := range args {
+		switch strings.ToUpper(arg.Bulk) {
+		case "NX":
+			cond.nx = true
+		case "XX":
+			cond.xx = true
+		case "GT":
+			cond.gt = true
+		case "LT":
+			cond.lt = true
+		default:
+			return cond, &resp.Value{Typ: "error", Str: fmt.Sprintf("ERR Unsupported option %s", arg.Bulk)}
+		}
+	}
+
+	if cond.nx && (cond.xx || cond.gt || cond.lt) {
+		return cond, &resp.Value{Typ: "error", Str: "ERR NX and XX, GT or LT options at the same time are not compatible"}
+	}
+	if cond.gt && cond.lt {
+		return cond, &resp.Value{Typ: "error", Str: "ERR GT and LT options at the same time are not compatible"}
+	}
+	return cond, nil
+}
+
+// expireAt sets the deadline of key when cond allows it. A deadline that has
+// already passed deletes the key straight away.
+func expireAt(db *Keyspace, key string, newExpiry time.Time, cond expireCondition) resp.Value {
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	value := db.lookupKeyWrite(key)
+	if value == nil {
+		return resp.Value{Typ: "integer", Num: 0} // Key does not exist
+	}
+
+	// A key without a deadline lives forever: no new deadline is greater than
+	// that, and any is less
+	switch {
+	case cond.nx && value.HasExpiry,
+		cond.xx && !value.HasExpiry,
+		cond.gt && (!value.HasExpiry || !newExpiry.After(value.Begone)),
+		cond.lt && value.HasExpiry && !newExpiry.Before(value.Begone):
+		return resp.Value{Typ: "integer", Num: 0}
+	}
+
+	// While the AOF is replayed the key is kept, see Object.expired
+	if !newExpiry.After(time.Now()) && !loading {
+		db.delete(key)
+		return resp.Value{Typ: "integer", Num: 1}
+	}
+
+	db.setExpiry(key, value, newExpiry)
+	return resp.Value{Typ: "integer", Num: 1}
+}
+
+// persist removes the deadline of a key, which then lives until deleted.
+func persist(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'persist' command"}
+	}
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	value := db.lookupKeyWrite(args[0].Bulk)
+	if value == nil || !value.HasExpiry {
+		return resp.Value{Typ: "integer", Num: 0}
+	}
+	db.persist(args[0].Bulk, value)
+	return resp.Value{Typ: "integer", Num: 1}
+}
+
+func ttl(db *Keyspace, args []resp.Value) resp.Value {
+	return ttlCommand(db, "ttl", args, false, false)
+}
+
+func pttl(db *Keyspace, args []resp.Value) resp.Value {
+	return ttlCommand(db, "pttl", args, true, false)
+}
+
+func expiretime(db *Keyspace, args []resp.Value) resp.Value {
+	return ttlCommand(db, "expiretime", args, false, true)
+}
+
+func pexpiretime(db *Keyspace, args []resp.Value) resp.Value {
+	return ttlCommand(db, "pexpiretime", args, true, true)
+}
+
+// ttlCommand implements the commands reading the deadline of a key: the time
+// left before it expires, or the deadline itself as a unix time when absolute
+// is set, in milliseconds or rounded to seconds. They reply -2 when the key
+// does not exist and -1 when it has no deadline.
+func ttlCommand(db *Keyspace, name string, args []resp.Value, ms, absolute bool) resp.Value {
+	if len(args) != 1 {
+		return resp.Value{
+			Typ: "error",
+			Str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name),
+		}
+	}
+
+	keyspaceMu.RLock()
+	value := db.lookupKey(args[0].Bulk)
+	exists := value != nil
+	hasExpiry := exists && value.HasExpiry
+	var deadline time.Time
+	if hasExpiry {
+		deadline = value.Begone
+	}
+	keyspaceMu.RUnlock()
+
+	switch {
+	case !exists:
+		return resp.Value{Typ: "integer", Num: -2}
+	case !hasExpiry:
+		return resp.Value{Typ: "integer", Num: -1}
+	}
+
+	t := deadline.UnixMilli()
+	if !absolute {
+		t = max(t-time.Now().UnixMilli(), 0)
+	}
+	if !ms {
+		t = (t + 500) / 1000
+	}
+	return resp.Value{Typ: "integer", Num: int(t)}
+}
+
+// The active expiry cycle, run by cron, follows the original algorithm of
+// Redis: sample a few keys among those that have a deadline, delete the ones
+// that expired, and go on with another sample as long as more than a quarter
+// of them had. Keys nobody reads any more are removed this way, and the share
+// of expired keys still taking memory stays around that quarter.
+const (
+	activeExpireKeysPerLoop = 20
+	activeExpireStalePerc   = 25
+	// Bound on the time spent per cycle, a quarter of the cron period
+	activeExpireTimeLimit = 25 * time.Millisecond
+)
+
+// activeExpireCycle goes over the databases, reclaiming in each one the
+// expired keys, then the expired fields of hashes the same way, sampling the
+// hashes that have fields with a deadline. A cycle cut short by the time limit
+// leaves the databases it did not get to for the next one.
+func (s *Server) activeExpireCycle() {
+	start := time.Now()
+	for range databases {
+		db := databases[s.expireDB]
+		s.expireDB = (s.expireDB + 1) % len(databases)
+		if !s.activeExpireDB(db, start) {
+			stats.expiredTimeCapReached.Add(1)
+			return
+		}
+	}
+}
+
+// activeExpireDB runs the expiry steps on db. It returns false once the cycle
+// started at start is out of time.
+func (s *Server) activeExpireDB(db *Keyspace, start time.Time) bool {
+	for _, step := range []func(*Keyspace) (sampled, expired int){s.activeExpireKeys, s.activeExpireFields} {
+		for {
+			sampled, expired := step(db)
+			if expired > 0 && s.aof != nil {
+				if err := s.aof.Commit(); err != nil {
+					fmt.Println("Error syncing the AOF:", err)
+				}
+			}
+
+			if expired*100 <= sampled*activeExpireStalePerc {
+				break
+			}
+			if time.Since(start) > activeExpireTimeLimit {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// activeExpireKeys samples keys that have a deadline and deletes those that
+// expired.
+func (s *Server) activeExpireKeys(db *Keyspace) (sampled, expired int) {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	keyspaceMu.Lock()
+	sampled = min(db.expires.len(), activeExpireKeysPerLoop)
+	var keys []expiredKey
+	now := time.Now()
+	for i := 0; i < sampled; i++ {
+		key, obj, _ := db.expires.random()
+		if obj.expired(now) {
+			db.delete(key)
+			keys = append(keys, expiredKey{db.id, key})
+		}
+	}
+	keyspaceMu.Unlock()
+
+	s.propagateExpired(keys)
+	return sampled, len(keys)
+}
+
+// activeExpireFields samples hashes that have fields with a deadline and
+// deletes the fields that expired, logged as one HDEL per hash. Every field
+// with a deadline of a sampled hash counts as sampled.
+func (s *Server) activeExpireFields(db *Keyspace) (sampled, expired int) {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	keyspaceMu.Lock()
+	var entries []resp.Value
+	now := time.Now()
+	for i := min(db.hexpires.len(), activeExpireKeysPerLoop); i > 0; i-- {
+		key, obj, ok := db.hexpires.random()
+		if !ok {
+			break // The last hash lost its last field
+		}
+		if obj.expired(now) {
+			continue // The whole key goes with activeExpireKeys
+		}
+
+		args := []resp.Value{{Typ: "bulk", Bulk: key}}
+		for field := range obj.FieldExpires {
+			sampled++
+			if obj.fieldExpired(field, now) {
+				args = append(args, resp.Value{Typ: "bulk", Bulk: field})
+			}
+		}
+		for _, field := range args[1:] {
+			db.deleteField(key, obj, field.Bulk)
+		}
+		if len(args) > 1 {
+			expired += len(args) - 1
+			entries = append(entries, commandValue("HDEL", args...))
+		}
+	}
+	keyspaceMu.Unlock()
+
+	stats.expiredFields.Add(int64(expired))
+	s.propagateDeletions(db.id, entries)
+	return sampled, expired
+}
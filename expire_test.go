@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// newCollections returns a database holding a hash and a list.
+func newCollections() *Keyspace {
+	db := newKeyspace(0)
+	command(db, "HSET", "hash", "field", "value")
+	command(db, "RPUSH", "list", "a", "b")
+	return db
+}
+
+func wantInteger(t *testing.T, got resp.Value, want int, what string) {
+	t.Helper()
+	if got.Typ != "integer" || got.Num != want {
+		t.Errorf("%s = %v, want %d", what, got, want)
+	}
+}
+
+func TestExpireHashAndList(t *testing.T) {
+	db := newCollections()
+	for _, key := range []string{"hash", "list"} {
+		wantInteger(t, command(db, "TTL", key), -1, "TTL "+key)
+		wantInteger(t, command(db, "EXPIRE", key, "100"), 1, "EXPIRE "+key)
+		wantInteger(t, command(db, "TTL", key), 100, "TTL "+key)
+		wantInteger(t, command(db, "EXPIRE", key, "200", "NX"), 0, "EXPIRE NX "+key)
+		wantInteger(t, command(db, "EXPIRE", key, "200", "GT"), 1, "EXPIRE GT "+key)
+		wantInteger(t, command(db, "TTL", key), 200, "TTL "+key)
+		if obj, _ := db.expires.get(key); obj == nil {
+			t.Errorf("%s is not among the keys with a deadline", key)
+		}
+
+		wantInteger(t, command(db, "PERSIST", key), 1, "PERSIST "+key)
+		wantInteger(t, command(db, "TTL", key), -1, "TTL "+key)
+		if obj, _ := db.expires.get(key); obj != nil {
+			t.Errorf("%s is still among the keys with a deadline", key)
+		}
+
+		// A deadline in the past deletes the key at once
+		wantInteger(t, command(db, "EXPIRE", key, "-1"), 1, "EXPIRE "+key+" -1")
+		wantInteger(t, command(db, "EXISTS", key), 0, "EXISTS "+key)
+	}
+	wantInteger(t, command(db, "EXPIRE", "missing", "100"), 0, "EXPIRE missing")
+}
+
+// Keys past their deadline read as missing, and a write starts them over.
+func TestLazyExpiryHashAndList(t *testing.T) {
+	db := newCollections()
+	command(db, "PEXPIRE", "hash", "20")
+	command(db, "PEXPIRE", "list", "20")
+	time.Sleep(40 * time.Millisecond)
+	defer takeExpiredKeys()
+
+	if got := command(db, "HGET", "hash", "field"); got.Typ != "null" {
+		t.Errorf("HGET of an expired hash = %v, want null", got)
+	}
+	if got := command(db, "LRANGE", "list", "0", "-1"); len(got.Array) != 0 {
+		t.Errorf("LRANGE of an expired list = %v, want nothing", got)
+	}
+	for _, key := range []string{"hash", "list"} {
+		wantInteger(t, command(db, "EXISTS", key), 0, "EXISTS "+key)
+		wantInteger(t, command(db, "TTL", key), -2, "TTL "+key)
+		if got := command(db, "TYPE", key); got.Str != "none" {
+			t.Errorf("TYPE %s = %v, want none", key, got)
+		}
+	}
+	// Reads hold keyspaceMu for reading only and leave the keys in place
+	if db.len() != 2 {
+		t.Errorf("reads removed expired keys, %d left", db.len())
+	}
+
+	command(db, "HSET", "hash", "other", "new")
+	command(db, "RPUSH", "list", "c")
+	if got := command(db, "HGETALL", "hash"); len(got.Array) != 2 || got.Array[0].Bulk != "other" {
+		t.Errorf("HGETALL of a hash written after it expired = %v, want only the new field", got)
+	}
+	if got := command(db, "LRANGE", "list", "0", "-1"); len(got.Array) != 1 || got.Array[0].Bulk != "c" {
+		t.Errorf("LRANGE of a list written after it expired = %v, want only the new element", got)
+	}
+	for _, key := range []string{"hash", "list"} {
+		wantInteger(t, command(db, "TTL", key), -1, "TTL "+key)
+	}
+	if keys := takeExpiredKeys(); len(keys) != 2 {
+		t.Errorf("writes removed %v, want the hash and the list", keys)
+	}
+}
+
+// The active expiry cycle reclaims expired keys nobody reads any more.
+func TestActiveExpiryHashAndList(t *testing.T) {
+	db := newKeyspace(0)
+	for i := range 100 {
+		command(db, "HSET", fmt.Sprintf("hash:%d", i), "field", "value")
+		command(db, "RPUSH", fmt.Sprintf("list:%d", i), "element")
+		command(db, "PEXPIRE", fmt.Sprintf("hash:%d", i), "10")
+		command(db, "PEXPIRE", fmt.Sprintf("list:%d", i), "10")
+	}
+	command(db, "HSET", "hash:kept", "field", "value")
+	command(db, "RPUSH", "list:kept", "element")
+	command(db, "EXPIRE", "list:kept", "100")
+	time.Sleep(30 * time.Millisecond)
+
+	s := &Server{}
+	before := stats.expiredKeys.Load()
+	s.activeExpireDB(db, time.Now())
+
+	// A cycle stops once few of the keys it samples expired, so a quarter of
+	// them may be left for the next cycles
+	if db.len() > 2+200/4 {
+		t.Errorf("%d keys left after a cycle, want most expired ones reclaimed", db.len())
+	}
+	for i := 0; i < 10 && db.len() > 2; i++ {
+		s.activeExpireDB(db, time.Now())
+	}
+	if db.len() != 2 {
+		t.Errorf("%d keys left after several cycles, want 2", db.len())
+	}
+	for _, key := range []string{"hash:kept", "list:kept"} {
+		wantInteger(t, command(db, "EXISTS", key), 1, "EXISTS "+key)
+	}
+	if db.expires.len() != 1 {
+		t.Errorf("%d keys with a deadline left, want list:kept only", db.expires.len())
+	}
+	if n := stats.expiredKeys.Load() - before; n != 200 {
+		t.Errorf("expired_keys went up by %d, want 200", n)
+	}
+	if s.dirty.Load() != 200 {
+		t.Errorf("%d changes recorded, want 200", s.dirty.Load())
+	}
+}
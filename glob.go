@@ -0,0 +1,101 @@
+package main
+
+// globMatch reports whether str matches a glob-style pattern, following the
+// rules of Redis for KEYS and the MATCH option of SCAN: a star matches any
+// sequence of bytes, including none, and a question mark any single byte.
+// Brackets match one of the bytes they list, like [abc], or a range of them
+// like [a-z], and [^abc] matches a byte that is not listed. A backslash makes
+// the character after it match itself.
+func globMatch(pattern, str string) bool {
+	skipLonger := false
+	return globMatchFrom(pattern, str, &skipLonger)
+}
+
+// globMatchFrom does the matching. Once a star failed to match against every
+// suffix of str, no star found further back can succeed by trying a shorter
+// prefix either, so skipLonger cuts the search short instead of letting a
+// pattern made of many stars take exponential time.
+func globMatchFrom(pattern, str string, skipLonger *bool) bool {
+	for len(pattern) > 0 && len(str) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for len(str) > 0 {
+				if globMatchFrom(pattern[1:], str, skipLonger) {
+					return true
+				}
+				if *skipLonger {
+					return false
+				}
+				str = str[1:]
+			}
+			*skipLonger = true
+			return false
+		case '?':
+			str = str[1:]
+		case '[':
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						match = true
+					}
+				case len(pattern) >= 3 && pattern[1] == '-':
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					if str[0] >= start && str[0] <= end {
+						match = true
+					}
+					pattern = pattern[2:]
+				case pattern[0] == str[0]:
+					match = true
+				}
+				pattern = pattern[1:]
+			}
+			// An unterminated bracket ends the pattern
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if pattern[0] != str[0] {
+				return false
+			}
+			str = str[1:]
+		}
+
+		if len(pattern) > 0 {
+			pattern = pattern[1:]
+		}
+	}
+	// Stars left once str is used up match the empty rest of it, which is
+	// also how "*" matches an empty string
+	if len(str) == 0 {
+		for len(pattern) > 0 && pattern[0] == '*' {
+			pattern = pattern[1:]
+		}
+	}
+	return len(pattern) == 0 && len(str) == 0
+}
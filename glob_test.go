@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, str string
+		want         bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"hello", "hello", true},
+		{"hello", "hell", false},
+
+		{"*", "anything", true},
+		{"a*", "a", true},
+		{"a**", "a", true},
+		{"h*llo", "hllo", true},
+		{"h*llo", "heeeello", true},
+		{"h*llo", "hello!", false},
+		{"*a*b", "xaxxb", true},
+
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"?", "", false},
+		{"??", "ab", true},
+		{"??", "abc", false},
+
+		{"h[ae]llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"[^a-c]", "d", true},
+		{"[^a-c]", "a", false},
+		{"[^a-c]", "b", false},
+		{"[^a-c]", "c", false},
+		{"[^a-c]", "", false},
+		{"[^a-c]", "dd", false},
+		{"[^a-c]x", "`x", true},
+		{"[c-a]", "b", true}, // Reversed ranges are accepted
+		{"[-a]", "-", true},
+		{"[-a]", "b", false},
+		// An unterminated bracket ends the pattern
+		{"a[bc", "ab", true},
+		{"a[bc", "abc", false},
+
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`\?`, "?", true},
+		{`\?`, "a", false},
+		{`\[a]`, "[a]", true},
+		{`\[a]`, "a", false},
+		{`\\`, `\`, true},
+		{`[\]]`, "]", true},
+		{`[\^a]`, "^", true},
+		{`[\-]`, "-", true},
+		{`[^\]]`, "]", false},
+		// A trailing backslash matches itself
+		{`a\`, `a\`, true},
+		{`a\`, "a", false},
+		{`a\`, "ab", false},
+		{`\`, `\`, true},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.str); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.str, got, tt.want)
+		}
+	}
+}
+
+// Many stars must not make a failed match take exponential time.
+func TestGlobMatchStars(t *testing.T) {
+	pattern := strings.Repeat("a*", 30) + "b"
+	if globMatch(pattern, strings.Repeat("a", 100)) {
+		t.Errorf("globMatch(%q) matched a string without b", pattern)
+	}
+	if !globMatch(pattern, strings.Repeat("a", 100)+"b") {
+		t.Errorf("globMatch(%q) did not match", pattern)
+	}
+
+	// Stars alone match the empty string too
+	for _, pattern := range []string{"*", "**"} {
+		if !globMatch(pattern, "") {
+			t.Errorf("globMatch(%q, \"\") = false, want true", pattern)
+		}
+	}
+}
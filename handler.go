@@ -3,364 +3,421 @@ package main
 import (
 	"fmt"
 	"strconv"
-	"strings"
-	"sync"
 	"time"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
 )
 
-// Redis commands are case-sensitive
-var Handlers = map[string]func([]Value) Value{
-	"PING":    ping,
-	"SET":     set,
-	"GET":     get,
-	"HSET":    hset,
-	"HGET":    hget,
-	"HGETALL": hgetall,
-  "LPUSH":   lpush,
-	"LPOP":    lpop,
-	"RPUSH":   rpush,
-	"RPOP":    rpop,
-	"LLEN":    llen,
-	"LRANGE":  lrange,
-	"BLPOP":   blpop,
-	"EXPIRE":  expireHandler,
-	"DEL":     Delete,
+// Redis commands are case-sensitive. They act on the database the client
+// selected.
+var Handlers = map[string]func(db *Keyspace, args []resp.Value) resp.Value{
+	"SET":          set,
+	"GET":          get,
+	"SETNX":        setnx,
+	"SETEX":        setex,
+	"PSETEX":       psetex,
+	"GETSET":       getset,
+	"GETEX":        getex,
+	"GETDEL":       getdel,
+	"MGET":         mget,
+	"MSET":         mset,
+	"MSETNX":       msetnx,
+	"INCR":         incr,
+	"INCRBY":       incrby,
+	"DECR":         decr,
+	"DECRBY":       decrby,
+	"INCRBYFLOAT":  incrbyfloat,
+	"APPEND":       appendHandler,
+	"STRLEN":       strlen,
+	"GETRANGE":     getrange,
+	"SETRANGE":     setrange,
+	"HSET":         hset,
+	"HGET":         hget,
+	"HGETALL":      hgetall,
+	"HDEL":         hdel,
+	"HEXPIRE":      hexpire,
+	"HPEXPIRE":     hpexpire,
+	"HEXPIREAT":    hexpireat,
+	"HPEXPIREAT":   hpexpireat,
+	"HPERSIST":     hpersist,
+	"HTTL":         httl,
+	"HPTTL":        hpttl,
+	"HEXPIRETIME":  hexpiretime,
+	"HPEXPIRETIME": hpexpiretime,
+	"LPUSH":        lpush,
+	"LPOP":         lpop,
+	"RPUSH":        rpush,
+	"RPOP":         rpop,
+	"LLEN":         llen,
+	"LRANGE":       lrange,
+	"BLPOP":        blpop,
+	"EXPIRE":       expireHandler,
+	"PEXPIRE":      pexpire,
+	"EXPIREAT":     expireat,
+	"PEXPIREAT":    pexpireat,
+	"PERSIST":      persist,
+	"TTL":          ttl,
+	"PTTL":         pttl,
+	"EXPIRETIME":   expiretime,
+	"PEXPIRETIME":  pexpiretime,
+	"DEL":          Delete,
+	"UNLINK":       unlink,
+	"TYPE":         typeHandler,
+	"EXISTS":       exists,
+	"TOUCH":        touch,
+	"RENAME":       rename,
+	"RENAMENX":     renamenx,
+	"COPY":         copyHandler,
+	"MOVE":         move,
+	"SWAPDB":       swapdb,
+	"DBSIZE":       dbsize,
+	"FLUSHDB":      flushdb,
+	"FLUSHALL":     flushall,
+	"KEYS":         keys,
+	"SCAN":         scan,
+	"HSCAN":        hscan,
 }
 
-func Delete(args []Value) Value {
+func Delete(db *Keyspace, args []resp.Value) resp.Value {
 	if len(args) < 1 {
-		return Value{
-			typ: "error",
-			str: "ERR wrong number of arguments for 'del' command",
+		return resp.Value{
+			Typ: "error",
+			Str: "ERR wrong number of arguments for 'del' command",
 		}
 	}
 	deletedCount := 0
+	keyspaceMu.Lock()
 	for _, arg := range args {
-		key := arg.bulk
-		SETsMu.Lock()
-		if _, ok := SETs[key]; ok {
-			delete(SETs, key)
-			fmt.Println("DEL: key=", key)
+		key := arg.Bulk
+		if db.lookupKeyWrite(key) != nil {
+			db.delete(key)
 			deletedCount++
 		}
-		SETsMu.Unlock() // Also delete from expiry map
 	}
-	fmt.Println("DEL: deletedCount=", deletedCount)
-	return Value{
-		typ: "integer",
-		num: deletedCount,
+	keyspaceMu.Unlock()
+	return resp.Value{
+		Typ: "integer",
+		Num: deletedCount,
 	}
 }
 
-func ping(args []Value) Value {
+func ping(client *Client, args []resp.Value) resp.Value {
 	if len(args) == 0 {
-		return Value{typ: "string", str: "PONG"}
+		return resp.Value{Typ: "string", Str: "PONG"}
 	}
-	return Value{typ: "string", str: args[0].bulk}
+	return resp.Value{Typ: "string", Str: args[0].Bulk}
 }
 
-type Values struct {
-	Content   string
-	Begone    time.Time
-	HasExpiry bool
+func set(db *Keyspace, args []resp.Value) resp.Value {
+	return setCommand(db, "set", args)
 }
 
-var SETs = make(map[string]Values)
-var SETsMu = sync.RWMutex{}
-
-func set(args []Value) Value {
+// setCommand implements SET key value [NX|XX] [GET] [EX seconds|PX
+// milliseconds|EXAT unix-time-seconds|PXAT unix-time-milliseconds|KEEPTTL]
+// for name, which is SET itself or one of its variants. Without GET it replies
+// OK, or null when NX or XX prevented the write; with GET it replies with the
+// string the key held before, whether it was replaced or not.
+func setCommand(db *Keyspace, name string, args []resp.Value) resp.Value {
 	if len(args) < 2 {
-		return Value{
-			typ: "error",
-			str: "ERR wrong number of arguments for 'set' command",
+		return resp.Value{
+			Typ: "error",
+			Str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name),
 		}
 	}
-
-	key := args[0].bulk
-	value := Values{Content: args[1].bulk}
-	expiry := false
-
-	for i := 2; i < len(args); i += 2 {
-		if i+1 < len(args) {
-			switch strings.ToUpper(args[i].bulk) {
-			case "PX":
-				expiry = true
-				ms, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
-				if err != nil {
-					return Value{typ: "error", str: "ERR invalid PX value"}
-				}
-				value.Begone = time.Now().Add(time.Duration(ms) * time.Millisecond)
-			case "EX":
-				expiry = true
-				s, err := strconv.Atoi(args[i+1].bulk)
-				if err != nil {
-					return Value{typ: "error", str: "ERR invalid EX value"}
-				}
-				value.Begone = time.Now().Add(time.Duration(s) * time.Second)
-			}
-		}
+	opts, errValue := parseSetOptions(args[2:], false)
+	if errValue != nil {
+		return *errValue
 	}
-
-	value.HasExpiry = expiry
-
-	SETsMu.Lock()
-	SETs[key] = value
-	SETsMu.Unlock()
-
-	fmt.Printf("SET: key=%s, value=%s, expiry=%v, Begone=%v\n", key, value.Content, value.HasExpiry, value.Begone)
-
-	return Value{typ: "string", str: "OK"}
-}
-
-func expireHandler(args []Value) Value {
-	if len(args) < 2 || len(args) > 3 {
-		return Value{
-			typ: "error",
-			str: "ERR wrong number of arguments for 'expire' command",
-		}
+	deadline, errValue := opts.deadline(name)
+	if errValue != nil {
+		return *errValue
 	}
 
-	key := args[0].bulk
-	seconds, err := strconv.Atoi(args[1].bulk)
-	if err != nil {
-		return Value{
-			typ: "error",
-			str: "ERR value is not an integer or out of range",
-		}
+	key := args[0].Bulk
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	old := db.lookupKeyWrite(key)
+	if opts.get && old != nil && old.Type != typeString {
+		return wrongType
 	}
 
-	var flag string
-	if len(args) == 3 {
-		flag = strings.ToUpper(args[2].bulk)
-		if flag != "NX" && flag != "XX" && flag != "GT" && flag != "LT" {
-			return Value{
-				typ: "error",
-				str: "ERR invalid flag value",
-			}
+	reply := resp.Value{Typ: "string", Str: "OK"}
+	if opts.get {
+		reply = resp.Value{Typ: "null"}
+		if old != nil {
+			reply = resp.Value{Typ: "bulk", Bulk: old.Content}
 		}
 	}
-
-	SETsMu.Lock()
-	defer SETsMu.Unlock()
-	value, ok := SETs[key]
-	if !ok {
-		return Value{typ: "integer", num: 0} // Key does not exist
-	}
-
-	now := time.Now()
-	newExpiry := now.Add(time.Duration(seconds) * time.Second)
-
-	applyExpiry := false
-	switch flag {
-	case "":
-		applyExpiry = true
-	case "NX":
-		if !value.HasExpiry {
-			applyExpiry = true
-		}
-	case "XX":
-		if value.HasExpiry {
-			applyExpiry = true
-		}
-	case "GT":
-		if !value.HasExpiry || newExpiry.After(value.Begone) {
-			applyExpiry = true
-		}
-	case "LT":
-		if !value.HasExpiry || newExpiry.Before(value.Begone) {
-			applyExpiry = true
+	if (opts.nx && old != nil) || (opts.xx && old == nil) {
+		if opts.get {
+			return reply
 		}
-	}
-
-	fmt.Println("EXPIRE: key=", key, "expiryTime=", newExpiry, "SETs[key]=", SETs[key])
-
-	if applyExpiry {
+		return resp.Value{Typ: "null"}
+	}
+
+	// SET replaces whatever the key held, whatever its type, and its
+	// deadline unless KEEPTTL is given
+	value := newString(args[1].Bulk)
+	switch {
+	case !deadline.IsZero() && !deadline.After(time.Now()) && !loading:
+		// A deadline in the past leaves no key, as with EXPIREAT
+		db.delete(key)
+		return reply
+	case !deadline.IsZero():
 		value.HasExpiry = true
-		value.Begone = newExpiry
-		SETs[key] = value
-		return Value{typ: "integer", num: 1}
+		value.Begone = deadline
+	case opts.keepTTL && old != nil:
+		value.HasExpiry = old.HasExpiry
+		value.Begone = old.Begone
 	}
-
-	fmt.Println("EXPIRE: key=", key, "expiryTime=", newExpiry, "SETs[key]=", SETs[key])
-
-	return Value{typ: "integer", num: 0}
+	db.set(key, value)
+	return reply
 }
 
-func get(args []Value) Value {
+func get(db *Keyspace, args []resp.Value) resp.Value {
 	if len(args) != 1 {
-		return Value{
-			typ: "error",
-			str: "ERR wrong number of arguments for 'get' command",
+		return resp.Value{
+			Typ: "error",
+			Str: "ERR wrong number of arguments for 'get' command",
 		}
 	}
 
-	key := args[0].bulk
-
-	SETsMu.RLock()
-	value, ok := SETs[key]
-	SETsMu.RUnlock()
+	key := args[0].Bulk
 
-	if ok && value.HasExpiry && time.Now().After(value.Begone) {
-		// Key needs to be-gone for good
-		SETsMu.Lock()
-		delete(SETs, key)
-		SETsMu.Unlock()
-		return Value{typ: "null"}
+	// A key that expired reads as missing. It is left for the expiry cycle
+	// to remove, since its deletion has to be logged in order with the
+	// writes.
+	keyspaceMu.RLock()
+	value := db.lookupKey(key)
+	var content string
+	if value != nil && value.Type == typeString {
+		content = value.Content
 	}
+	keyspaceMu.RUnlock()
 
-	if !ok {
-		return Value{typ: "null"}
+	if value == nil {
+		return resp.Value{Typ: "null"}
+	}
+	if value.Type != typeString {
+		return wrongType
 	}
 
-	return Value{
-		typ:  "bulk",
-		bulk: value.Content,
+	return resp.Value{
+		Typ:  "bulk",
+		Bulk: content,
 	}
 }
 
-var HSETs = make(map[string]map[string]string)
-var HSETsMu = sync.RWMutex{}
-
-func hset(args []Value) Value {
+func hset(db *Keyspace, args []resp.Value) resp.Value {
 	if len(args) != 3 {
-		return Value{
-			typ: "error",
-			str: "ERR wrong number of arguments for 'hset' command",
+		return resp.Value{
+			Typ: "error",
+			Str: "ERR wrong number of arguments for 'hset' command",
 		}
 	}
 
-	hash := args[0].bulk
-	key := args[1].bulk
-	value := args[2].bulk
+	hash := args[0].Bulk
+	key := args[1].Bulk
+	value := args[2].Bulk
 
-	HSETsMu.Lock()
-	defer HSETsMu.Unlock()
-	if _, ok := HSETs[hash]; !ok {
-		HSETs[hash] = make(map[string]string)
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	obj := db.lookupKeyWrite(hash)
+	if obj == nil {
+		obj = newHash()
+		db.set(hash, obj)
 	}
-	HSETs[hash][key] = value
+	if obj.Type != typeHash {
+		return wrongType
+	}
+	obj.Hash.set(key, value)
+	db.persistField(hash, obj, key)
 
-	return Value{typ: "string", str: "OK"}
+	return resp.Value{Typ: "string", Str: "OK"}
 }
 
-func hget(args []Value) Value {
+func hget(db *Keyspace, args []resp.Value) resp.Value {
 	if len(args) != 2 {
-		return Value{
-			typ: "error",
-			str: "ERR wrong number of arguments for 'hget' command",
+		return resp.Value{
+			Typ: "error",
+			Str: "ERR wrong number of arguments for 'hget' command",
 		}
 	}
 
-	hash := args[0].bulk
-	key := args[1].bulk
+	hash := args[0].Bulk
+	key := args[1].Bulk
 
-	HSETsMu.RLock()
-	value, ok := HSETs[hash][key]
-	HSETsMu.RUnlock()
+	keyspaceMu.RLock()
+	defer keyspaceMu.RUnlock()
+	obj := db.lookupKey(hash)
+	if obj == nil {
+		return resp.Value{Typ: "null"}
+	}
+	if obj.Type != typeHash {
+		return wrongType
+	}
 
-	if !ok {
-		return Value{typ: "null"}
+	value, ok := obj.Hash.get(key)
+	if !ok || obj.fieldExpired(key, time.Now()) {
+		return resp.Value{Typ: "null"}
 	}
 
-	return Value{
-		typ:  "bulk",
-		bulk: value,
+	return resp.Value{
+		Typ:  "bulk",
+		Bulk: value,
 	}
 }
 
-func hgetall(args []Value) Value {
+func hgetall(db *Keyspace, args []resp.Value) resp.Value {
 	if len(args) != 1 {
-		return Value{
-			typ: "error",
-			str: "ERR wrong number of arguments for 'hgetall' command",
+		return resp.Value{
+			Typ: "error",
+			Str: "ERR wrong number of arguments for 'hgetall' command",
 		}
 	}
 
-	hash := args[0].bulk
+	hash := args[0].Bulk
+
+	keyspaceMu.RLock()
+	defer keyspaceMu.RUnlock()
+	obj := db.lookupKey(hash)
+	if obj != nil && obj.Type != typeHash {
+		return wrongType
+	}
+
+	// A missing hash is just an empty one. The reply is a map for RESP3
+	// clients and the usual flat field/value array for RESP2 ones.
+	reply := []resp.Value{}
+	if obj != nil {
+		now := time.Now()
+		for k, v := range obj.Hash.all() {
+			if obj.fieldExpired(k, now) {
+				continue
+			}
+			reply = append(reply, resp.Value{Typ: "bulk", Bulk: k})
+			reply = append(reply, resp.Value{Typ: "bulk", Bulk: v})
+		}
+	}
 
-	HSETsMu.RLock()
-	value, ok := HSETs[hash]
-	HSETsMu.RUnlock()
+	return resp.Value{
+		Typ:   "map",
+		Array: reply,
+	}
+}
 
-	if !ok {
-		return Value{typ: "null"}
+// hdel implements HDEL key field [field ...] and replies with the number of
+// fields removed. Fields that expired already count as missing.
+func hdel(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'hdel' command"}
 	}
+	hash := args[0].Bulk
 
-	resp := []Value{}
-	for k, v := range value {
-		resp = append(resp, Value{typ: "bulk", bulk: k})
-		resp = append(resp, Value{typ: "bulk", bulk: v})
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	obj := db.lookupKeyWrite(hash)
+	if obj == nil {
+		return resp.Value{Typ: "integer", Num: 0}
+	}
+	if obj.Type != typeHash {
+		return wrongType
 	}
 
-	return Value{
-		typ:   "array",
-		array: resp,
+	now := time.Now()
+	deleted := 0
+	for _, arg := range args[1:] {
+		if obj.fieldExpired(arg.Bulk, now) {
+			continue
+		}
+		if db.deleteField(hash, obj, arg.Bulk) {
+			deleted++
+		}
 	}
+	return resp.Value{Typ: "integer", Num: deleted}
 }
 
-// Define listStore as a map where the keys are strings and the values are pointers to DoublyLinkedList.
-var listStore = make(map[string]*DoublyLinkedList)
-var listStoreMu sync.Mutex
+// lookupList returns the list stored at key for a write command, creating an
+// empty one when create is set and the key does not exist. A nil list with a
+// nil error means there is no such key.
+func lookupList(db *Keyspace, key string, create bool) (*DoublyLinkedList, *resp.Value) {
+	obj := db.lookupKeyWrite(key)
+	if obj == nil {
+		if !create {
+			return nil, nil
+		}
+		obj = newList()
+		db.set(key, obj)
+	}
+	if obj.Type != typeList {
+		return nil, &wrongType
+	}
+	return obj.List, nil
+}
 
-func lpush(args []Value) Value {
+func lpush(db *Keyspace, args []resp.Value) resp.Value {
 	// fmt.Println("Received LPUSH command with arguments:", args)
 
 	if len(args) != 2 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'lpush' command"}
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'lpush' command"}
 	}
 
-	key := args[0].bulk
-	value := args[1].bulk
+	key := args[0].Bulk
+	value := args[1].Bulk
 
-	listStoreMu.Lock()
-	list, exists := listStore[key]
-	if !exists {
-		list = NewDoublyLinkedList()
-		listStore[key] = list
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	list, errValue := lookupList(db, key, true)
+	if errValue != nil {
+		return *errValue
 	}
-	listStoreMu.Unlock()
 
 	length := list.PushLeft(value)
 
 	// fmt.Println("List length after LPUSH:", length)
 
-	return Value{typ: "integer", num: length}
+	return resp.Value{Typ: "integer", Num: length}
 }
 
-func lpop(args []Value) Value {
+func lpop(db *Keyspace, args []resp.Value) resp.Value {
 	// fmt.Println("Received LPOP command with arguments:", args)
 
 	if len(args) < 1 || len(args) > 2 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'lpop' command"}
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'lpop' command"}
 	}
 
-	key := args[0].bulk
+	key := args[0].Bulk
 	count := 1 // Default to popping one element
 	if len(args) == 2 {
 		var err error
-		count, err = strconv.Atoi(args[1].bulk)
+		count, err = strconv.Atoi(args[1].Bulk)
 		if err != nil || count <= 0 {
-			return Value{typ: "error", str: "ERR invalid count argument for 'lpop' command"}
+			return resp.Value{Typ: "error", Str: "ERR invalid count argument for 'lpop' command"}
 		}
 	}
 
-	listStoreMu.Lock()
-	list, exists := listStore[key]
-	if !exists || list.Length() == 0 {
-		listStoreMu.Unlock()
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	list, errValue := lookupList(db, key, false)
+	if errValue != nil {
+		return *errValue
+	}
+	if list == nil || list.Length() == 0 {
 		fmt.Println("List does not exist or is empty")
-		return Value{typ: "null"}
+		return resp.Value{Typ: "null"}
 	}
-	listStoreMu.Unlock()
 
-	result := make([]Value, 0, count)
+	result := make([]resp.Value, 0, count)
 	for i := 0; i < count && list.Length() > 0; i++ {
 		value, ok := list.PopLeft()
 		if !ok {
 			fmt.Println("Failed to pop from list")
-			return Value{typ: "null"}
+			return resp.Value{Typ: "null"}
 		}
-		result = append(result, Value{typ: "bulk", bulk: fmt.Sprintf("%v", value)})
+		result = append(result, resp.Value{Typ: "bulk", Bulk: fmt.Sprintf("%v", value)})
+	}
+	// Like in Redis a list is gone once its last element is
+	if list.Length() == 0 {
+		db.delete(key)
 	}
 
 	// fmt.Println("List length after LPOP:", list.Length())
@@ -368,189 +425,189 @@ func lpop(args []Value) Value {
 
 	// If only one element is popped, return it as a bulk string wrapped in a Value.
 	if len(result) == 1 {
-		return Value{typ: "bulk", bulk: result[0].bulk}
+		return resp.Value{Typ: "bulk", Bulk: result[0].Bulk}
 	}
 	// Otherwise, return an array of bulk strings.
-	return Value{typ: "array", array: result}
+	return resp.Value{Typ: "array", Array: result}
 }
 
-func rpush(args []Value) Value {
+func rpush(db *Keyspace, args []resp.Value) resp.Value {
 	if len(args) < 2 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'rpush' command"}
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'rpush' command"}
 	}
 
-	key := args[0].bulk
+	key := args[0].Bulk
 	elements := args[1:]
 
-	listStoreMu.Lock()
-	list, exists := listStore[key]
-	if !exists {
-		list = NewDoublyLinkedList()
-		listStore[key] = list
+	keyspaceMu.Lock()
+	list, errValue := lookupList(db, key, true)
+	if errValue != nil {
+		keyspaceMu.Unlock()
+		return *errValue
 	}
 	for _, element := range elements {
-		list.PushRight(element.bulk)
+		list.PushRight(element.Bulk)
 	}
 	length := list.Length()
-	listStoreMu.Unlock()
+	keyspaceMu.Unlock()
 
-	return Value{
-		typ: "integer",
-		num: length,
+	return resp.Value{
+		Typ: "integer",
+		Num: length,
 	}
 }
 
-func rpop(args []Value) Value {
+func rpop(db *Keyspace, args []resp.Value) resp.Value {
 	if len(args) < 1 || len(args) > 2 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'rpop' command"}
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'rpop' command"}
 	}
 
-	key := args[0].bulk
+	key := args[0].Bulk
 	count := 1
 	if len(args) == 2 {
 		var err error
-		count, err = strconv.Atoi(args[1].bulk)
+		count, err = strconv.Atoi(args[1].Bulk)
 		if err != nil || count <= 0 {
-			return Value{typ: "error", str: "ERR invalid count argument for 'rpop' command"}
+			return resp.Value{Typ: "error", Str: "ERR invalid count argument for 'rpop' command"}
 		}
 	}
 
-	listStoreMu.Lock()
-	list, exists := listStore[key]
-	if !exists || list.Length() == 0 {
-		listStoreMu.Unlock()
-		return Value{typ: "null"}
+	keyspaceMu.Lock()
+	list, errValue := lookupList(db, key, false)
+	if errValue != nil {
+		keyspaceMu.Unlock()
+		return *errValue
+	}
+	if list == nil || list.Length() == 0 {
+		keyspaceMu.Unlock()
+		return resp.Value{Typ: "null"}
 	}
 
-	result := make([]Value, 0, count)
+	result := make([]resp.Value, 0, count)
 	for i := 0; i < count && list.Length() > 0; i++ {
 		value, _ := list.PopRight()
-		result = append(result, Value{typ: "bulk", bulk: fmt.Sprintf("%v", value)})
+		result = append(result, resp.Value{Typ: "bulk", Bulk: fmt.Sprintf("%v", value)})
 	}
-	listStoreMu.Unlock()
+	if list.Length() == 0 {
+		db.delete(key)
+	}
+	keyspaceMu.Unlock()
 
 	if len(result) == 1 {
 		return result[0]
 	}
-	return Value{
-		typ:   "array",
-		array: result,
+	return resp.Value{
+		Typ:   "array",
+		Array: result,
 	}
 }
 
-func llen(args []Value) Value {
+func llen(db *Keyspace, args []resp.Value) resp.Value {
 	if len(args) != 1 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'llen' command"}
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'llen' command"}
 	}
 
-	key := args[0].bulk
+	key := args[0].Bulk
 
-	listStoreMu.Lock()
-	list, exists := listStore[key]
+	keyspaceMu.RLock()
+	obj := db.lookupKey(key)
 	length := 0
-	if exists {
-		length = list.Length()
+	if obj != nil && obj.Type == typeList {
+		length = obj.List.Length()
+	}
+	keyspaceMu.RUnlock()
+
+	if obj != nil && obj.Type != typeList {
+		return wrongType
 	}
-	listStoreMu.Unlock()
 
-	return Value{
-		typ: "integer",
-		num: length,
+	return resp.Value{
+		Typ: "integer",
+		Num: length,
 	}
 }
 
-func lrange(args []Value) Value {
+func lrange(db *Keyspace, args []resp.Value) resp.Value {
 	if len(args) != 3 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'lrange' command"}
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'lrange' command"}
 	}
 
-	key := args[0].bulk
-	start, err1 := strconv.Atoi(args[1].bulk)
-	end, err2 := strconv.Atoi(args[2].bulk)
+	key := args[0].Bulk
+	start, err1 := strconv.Atoi(args[1].Bulk)
+	end, err2 := strconv.Atoi(args[2].Bulk)
 	if err1 != nil || err2 != nil {
-		return Value{typ: "error", str: "ERR invalid arguments for 'lrange' command"}
+		return resp.Value{Typ: "error", Str: "ERR invalid arguments for 'lrange' command"}
 	}
 
-	listStoreMu.Lock()
-	list, exists := listStore[key]
-	if !exists {
-		listStoreMu.Unlock()
-		return Value{
-			typ:   "array",
-			array: []Value{},
+	keyspaceMu.RLock()
+	obj := db.lookupKey(key)
+	if obj == nil {
+		keyspaceMu.RUnlock()
+		return resp.Value{
+			Typ:   "array",
+			Array: []resp.Value{},
 		}
 	}
+	if obj.Type != typeList {
+		keyspaceMu.RUnlock()
+		return wrongType
+	}
 
-	values := list.ExtractRange(start, end)
-	result := make([]Value, len(values))
+	values := obj.List.ExtractRange(start, end)
+	result := make([]resp.Value, len(values))
 	for i, v := range values {
-		result[i] = Value{typ: "bulk", bulk: fmt.Sprintf("%v", v)}
+		result[i] = resp.Value{Typ: "bulk", Bulk: fmt.Sprintf("%v", v)}
 	}
-	listStoreMu.Unlock()
+	keyspaceMu.RUnlock()
 
-	return Value{
-		typ:   "array",
-		array: result,
+	return resp.Value{
+		Typ:   "array",
+		Array: result,
 	}
 }
 
-func blpop(args []Value) Value {
+func blpop(db *Keyspace, args []resp.Value) resp.Value {
 	if len(args) < 2 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'blpop' command"}
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'blpop' command"}
+	}
+	if _, ok := blpopTimeout(args); !ok {
+		return resp.Value{Typ: "error", Str: "ERR invalid timeout argument for 'blpop' command"}
 	}
 
-	// Extract keys and timeout.
+	// A single attempt: waiting for a push is up to Server.call (see
+	// blockingCommands), which retries with writeMu released in between
 	keys := args[:len(args)-1]
-	timeout, err := strconv.Atoi(args[len(args)-1].bulk)
-	if err != nil || timeout < 0 {
-		return Value{typ: "error", str: "ERR invalid timeout argument for 'blpop' command"}
-	}
-
-	// Create a ticker for polling and a timer for timeout.
-	ticker := time.NewTicker(50 * time.Millisecond)
-	defer ticker.Stop()
-
-	var timer *time.Timer
-	var timerC <-chan time.Time
-
-	if timeout > 0 {
-		timer = time.NewTimer(time.Duration(timeout) * time.Second)
-		defer timer.Stop()
-		timerC = timer.C
-	}
-
-	// Main loop
-	for {
-		// Check all keys under lock.
-		listStoreMu.Lock()
-		for _, key := range keys {
-			list, exists := listStore[key.bulk]
-			if exists && list.Length() > 0 {
-				value, _ := list.PopLeft()
-				listStoreMu.Unlock()
-
-				return Value{
-					typ: "array",
-					array: []Value{
-						{typ: "bulk", bulk: key.bulk},
-						{typ: "bulk", bulk: fmt.Sprintf("%v", value)},
-					},
-				}
-			}
-		}
-		listStoreMu.Unlock()
-
-		// Wait for either timeout or next tick.
-		select {
-		case <-timerC:
-			return Value{typ: "null"}
-		case <-ticker.C:
-			// Continue to next iteration.
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	for _, key := range keys {
+		list, errValue := lookupList(db, key.Bulk, false)
+		if errValue != nil {
+			return *errValue
 		}
+		if list != nil && list.Length() > 0 {
+			value, _ := list.PopLeft()
+			if list.Length() == 0 {
+				db.delete(key.Bulk)
+			}
 
-		// If timeout is 0, return immediately.
-		if timeout == 0 {
-			return Value{typ: "null"}
+			return resp.Value{
+				Typ: "array",
+				Array: []resp.Value{
+					{Typ: "bulk", Bulk: key.Bulk},
+					{Typ: "bulk", Bulk: fmt.Sprintf("%v", value)},
+				},
+			}
 		}
 	}
+	return resp.Value{Typ: "null"}
+}
+
+// blpopTimeout returns how long BLPOP may wait for one of its lists to have
+// an element, its last argument in seconds.
+func blpopTimeout(args []resp.Value) (time.Duration, bool) {
+	timeout, err := strconv.Atoi(args[len(args)-1].Bulk)
+	if err != nil || timeout < 0 {
+		return 0, false
+	}
+	return time.Duration(timeout) * time.Second, true
 }
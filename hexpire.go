@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// Commands that set, read and remove the deadlines of the fields of a hash.
+// The fields come last, as FIELDS numfields field [field ...], and the reply
+// has one integer per field, -2 for a field that does not exist. As for keys,
+// deadlines are logged to the AOF as an absolute HPEXPIREAT.
+
+// The latest deadline a field can have, in unix milliseconds.
+const maxFieldExpire = 1<<48 - 1
+
+func hexpire(db *Keyspace, args []resp.Value) resp.Value {
+	return hexpireCommand(db, "hexpire", args, time.Second, false)
+}
+
+func hpexpire(db *Keyspace, args []resp.Value) resp.Value {
+	return hexpireCommand(db, "hpexpire", args, time.Millisecond, false)
+}
+
+func hexpireat(db *Keyspace, args []resp.Value) resp.Value {
+	return hexpireCommand(db, "hexpireat", args, time.Second, true)
+}
+
+func hpexpireat(db *Keyspace, args []resp.Value) resp.Value {
+	return hexpireCommand(db, "hpexpireat", args, time.Millisecond, true)
+}
+
+// parseFields parses FIELDS numfields field [field ...], which must be all
+// that is left of args.
+func parseFields(args []resp.Value) ([]string, *resp.Value) {
+	if len(args) < 2 || strings.ToUpper(args[0].Bulk) != "FIELDS" {
+		return nil, &resp.Value{Typ: "error", Str: "ERR Mandatory argument FIELDS is missing or not at the right position"}
+	}
+	n, err := strconv.Atoi(args[1].Bulk)
+	if err != nil || n < 1 {
+		return nil, &resp.Value{Typ: "error", Str: "ERR Number of fields must be a positive integer"}
+	}
+	if n != len(args)-2 {
+		return nil, &resp.Value{Typ: "error", Str: "ERR The `numfields` parameter must match the number of arguments"}
+	}
+
+	fields := make([]string, n)
+	for i, arg := range args[2:] {
+		fields[i] = arg.Bulk
+	}
+	return fields, nil
+}
+
+// fieldReplies returns the reply for fields none of which exist.
+func fieldReplies(n int) resp.Value {
+	replies := make([]resp.Value, n)
+	for i := range replies {
+		replies[i] = resp.Value{Typ: "integer", Num: -2}
+	}
+	return resp.Value{Typ: "array", Array: replies}
+}
+
+// hexpireCommand implements the HEXPIRE family: a key, a time given in unit,
+// either relative to now or a unix time when absolute is set, at most one of
+// the condition flags of EXPIRE, and the fields. It replies per field 1 when
+// the deadline was set, 0 when the condition was not met and 2 when the field
+// was deleted because the deadline already passed.
+func hexpireCommand(db *Keyspace, name string, args []resp.Value, unit time.Duration, absolute bool) resp.Value {
+	if len(args) < 5 {
+		return resp.Value{
+			Typ: "error",
+			Str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name),
+		}
+	}
+
+	key := args[0].Bulk
+	when, err := strconv.ParseInt(args[1].Bulk, 10, 64)
+	if err != nil {
+		return resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+	}
+	invalid := resp.Value{Typ: "error", Str: fmt.Sprintf("ERR invalid expire time, must be >= 0 and <= %d", maxFieldExpire)}
+	factor := int64(unit / time.Millisecond)
+	if when < 0 || when > maxFieldExpire/factor {
+		return invalid
+	}
+	ms := when * factor
+	if !absolute {
+		ms += time.Now().UnixMilli()
+	}
+	if ms > maxFieldExpire {
+		return invalid
+	}
+	deadline := time.UnixMilli(ms)
+
+	rest := args[2:]
+	var cond expireCondition
+	if strings.ToUpper(rest[0].Bulk) != "FIELDS" {
+		var errValue *resp.Value
+		if cond, errValue = parseExpireCondition(rest[:1]); errValue != nil {
+			return *errValue
+		}
+		rest = rest[1:]
+	}
+	fields, errValue := parseFields(rest)
+	if errValue != nil {
+		return *errValue
+	}
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	obj := db.lookupKeyWrite(key)
+	if obj == nil {
+		return fieldReplies(len(fields))
+	}
+	if obj.Type != typeHash {
+		return wrongType
+	}
+
+	now := time.Now()
+	replies := make([]resp.Value, len(fields))
+	for i, field := range fields {
+		replies[i] = resp.Value{Typ: "integer", Num: hexpireField(db, key, obj, field, deadline, cond, now)}
+	}
+	return resp.Value{Typ: "array", Array: replies}
+}
+
+// hexpireField sets the deadline of one field for hexpireCommand and returns
+// its reply.
+func hexpireField(db *Keyspace, key string, obj *Object, field string, deadline time.Time, cond expireCondition, now time.Time) int {
+	if _, ok := obj.Hash.get(field); !ok || obj.fieldExpired(field, now) {
+		return -2
+	}
+
+	// A field without a deadline lives forever, as a key does
+	current, hasExpiry := obj.FieldExpires[field]
+	switch {
+	case cond.nx && hasExpiry,
+		cond.xx && !hasExpiry,
+		cond.gt && (!hasExpiry || !deadline.After(current)),
+		cond.lt && hasExpiry && !deadline.Before(current):
+		return 0
+	}
+
+	if !deadline.After(now) && !loading {
+		db.deleteField(key, obj, field)
+		return 2
+	}
+	db.setFieldExpiry(key, obj, field, deadline)
+	return 1
+}
+
+// hexpireEntries returns the AOF entries of the HEXPIRE family: an HPEXPIREAT
+// for the fields that were given a deadline, which is the same for all of
+// them, and an HDEL for the fields deleted because it had passed.
+func hexpireEntries(db *Keyspace, args []resp.Value, result resp.Value) []resp.Value {
+	key := args[0]
+	fields := args[len(args)-len(result.Array):]
+	var expired, deleted []resp.Value
+	for i, reply := range result.Array {
+		switch reply.Num {
+		case 1:
+			expired = append(expired, fields[i])
+		case 2:
+			deleted = append(deleted, fields[i])
+		}
+	}
+
+	var entries []resp.Value
+	if len(expired) > 0 {
+		keyspaceMu.RLock()
+		obj, _ := db.get(key.Bulk)
+		deadline := obj.FieldExpires[expired[0].Bulk]
+		keyspaceMu.RUnlock()
+
+		entry := commandValue("HPEXPIREAT", key,
+			resp.Value{Typ: "bulk", Bulk: strconv.FormatInt(deadline.UnixMilli(), 10)},
+			resp.Value{Typ: "bulk", Bulk: "FIELDS"},
+			resp.Value{Typ: "bulk", Bulk: strconv.Itoa(len(expired))})
+		entry.Array = append(entry.Array, expired...)
+		entries = append(entries, entry)
+	}
+	if len(deleted) > 0 {
+		entries = append(entries, commandValue("HDEL", append([]resp.Value{key}, deleted...)...))
+	}
+	return entries
+}
+
+func httl(db *Keyspace, args []resp.Value) resp.Value {
+	return httlCommand(db, "httl", args, false, false)
+}
+
+func hpttl(db *Keyspace, args []resp.Value) resp.Value {
+	return httlCommand(db, "hpttl", args, true, false)
+}
+
+func hexpiretime(db *Keyspace, args []resp.Value) resp.Value {
+	return httlCommand(db, "hexpiretime", args, false, true)
+}
+
+func hpexpiretime(db *Keyspace, args []resp.Value) resp.Value {
+	return httlCommand(db, "hpexpiretime", args, true, true)
+}
+
+// httlCommand implements the commands reading the deadlines of fields, the
+// counterpart of ttlCommand for keys. They reply per field -1 when it has no
+// deadline.
+func httlCommand(db *Keyspace, name string, args []resp.Value, ms, absolute bool) resp.Value {
+	if len(args) < 4 {
+		return resp.Value{
+			Typ: "error",
+			Str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name),
+		}
+	}
+	fields, errValue := parseFields(args[1:])
+	if errValue != nil {
+		return *errValue
+	}
+
+	keyspaceMu.RLock()
+	defer keyspaceMu.RUnlock()
+	obj := db.lookupKey(args[0].Bulk)
+	if obj == nil {
+		return fieldReplies(len(fields))
+	}
+	if obj.Type != typeHash {
+		return wrongType
+	}
+
+	now := time.Now()
+	replies := make([]resp.Value, len(fields))
+	for i, field := range fields {
+		replies[i] = resp.Value{Typ: "integer", Num: -2}
+		if _, ok := obj.Hash.get(field); !ok || obj.fieldExpired(field, now) {
+			continue
+		}
+		deadline, ok := obj.FieldExpires[field]
+		if !ok {
+			replies[i].Num = -1
+			continue
+		}
+
+		t := deadline.UnixMilli()
+		if !absolute {
+			t = max(t-now.UnixMilli(), 0)
+		}
+		if !ms {
+			t = (t + 500) / 1000
+		}
+		replies[i].Num = int(t)
+	}
+	return resp.Value{Typ: "array", Array: replies}
+}
+
+// hpersist implements HPERSIST key FIELDS numfields field [field ...]. It
+// replies per field 1 when its deadline was removed and -1 when it had none.
+func hpersist(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) < 4 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'hpersist' command"}
+	}
+	fields, errValue := parseFields(args[1:])
+	if errValue != nil {
+		return *errValue
+	}
+
+	key := args[0].Bulk
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	obj := db.lookupKeyWrite(key)
+	if obj == nil {
+		return fieldReplies(len(fields))
+	}
+	if obj.Type != typeHash {
+		return wrongType
+	}
+
+	now := time.Now()
+	replies := make([]resp.Value, len(fields))
+	for i, field := range fields {
+		replies[i] = resp.Value{Typ: "integer", Num: -2}
+		if _, ok := obj.Hash.get(field); !ok || obj.fieldExpired(field, now) {
+			continue
+		}
+		replies[i].Num = -1
+		if db.persistField(key, obj, field) {
+			replies[i].Num = 1
+		}
+	}
+	return resp.Value{Typ: "array", Array: replies}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// newHashWith returns a database holding a hash with the given fields, each
+// having its own name as value.
+func newHashWith(fields ...string) *Keyspace {
+	db := newKeyspace(0)
+	for _, field := range fields {
+		command(db, "HSET", "hash", field, field)
+	}
+	return db
+}
+
+// integers returns the integers of an array reply, nil for any other reply.
+func integers(reply resp.Value) []int {
+	if reply.Typ != "array" {
+		return nil
+	}
+	nums := []int{}
+	for _, element := range reply.Array {
+		nums = append(nums, element.Num)
+	}
+	return nums
+}
+
+func TestHexpireReplies(t *testing.T) {
+	later := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	tests := []struct {
+		args string
+		want []int
+	}{
+		{"HEXPIRE hash 100 FIELDS 2 a missing", []int{1, -2}},
+		{"HEXPIRE hash 100 NX FIELDS 2 a b", []int{0, 1}},
+		{"HEXPIRE hash 100 XX FIELDS 2 a c", []int{1, 0}},
+		{"HEXPIRE hash 50 GT FIELDS 2 a c", []int{0, 0}},
+		{"HEXPIRE hash 200 GT FIELDS 1 a", []int{1}},
+		{"HEXPIRE hash 50 LT FIELDS 2 a c", []int{1, 1}},
+		{"HEXPIREAT hash " + later + " FIELDS 1 b", []int{1}},
+		{"HPEXPIRE hash 0 FIELDS 2 b missing", []int{2, -2}},
+		{"HTTL hash FIELDS 4 a b c missing", []int{50, -2, 50, -2}},
+		{"HPERSIST hash FIELDS 3 a d missing", []int{1, -1, -2}},
+		{"HPERSIST hash FIELDS 1 a", []int{-1}},
+		{"HTTL hash FIELDS 2 a d", []int{-1, -1}},
+		{"HEXPIREAT hash 1 FIELDS 1 d", []int{2}},
+		{"HEXPIRE missing 100 FIELDS 2 a b", []int{-2, -2}},
+		{"HPERSIST missing FIELDS 1 a", []int{-2}},
+	}
+	db := newHashWith("a", "b", "c", "d")
+	for _, tt := range tests {
+		args := strings.Fields(tt.args)
+		if got := integers(command(db, args[0], args[1:]...)); !slices.Equal(got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+	if got := command(db, "HGETALL", "hash"); len(got.Array) != 4 {
+		t.Errorf("HGETALL = %v, want a and c left", got)
+	}
+
+	// A hash whose last field is deleted goes away
+	command(db, "HEXPIRE", "hash", "0", "FIELDS", "2", "a", "c")
+	wantInteger(t, command(db, "EXISTS", "hash"), 0, "EXISTS hash")
+}
+
+func TestHexpireErrors(t *testing.T) {
+	db := newHashWith("a")
+	command(db, "RPUSH", "list", "a")
+	tests := []struct {
+		args string
+		want string
+	}{
+		{"HEXPIRE list 100 FIELDS 1 a", wrongType.Str},
+		{"HPERSIST list FIELDS 1 a", wrongType.Str},
+		{"HEXPIRE hash x FIELDS 1 a", "ERR value is not an integer or out of range"},
+		{"HEXPIRE hash -1 FIELDS 1 a", fmt.Sprintf("ERR invalid expire time, must be >= 0 and <= %d", maxFieldExpire)},
+		{fmt.Sprintf("HPEXPIREAT hash %d FIELDS 1 a", maxFieldExpire+1), fmt.Sprintf("ERR invalid expire time, must be >= 0 and <= %d", maxFieldExpire)},
+		{"HEXPIRE hash 100 NX XX FIELDS 1 a", "ERR Mandatory argument FIELDS is missing or not at the right position"},
+		{"HEXPIRE hash 100 BOGUS FIELDS 1 a", "ERR Unsupported option BOGUS"},
+		{"HEXPIRE hash 100 FIELDS 0 a", "ERR Number of fields must be a positive integer"},
+		{"HEXPIRE hash 100 FIELDS 2 a", "ERR The `numfields` parameter must match the number of arguments"},
+		{"HPERSIST hash FIELDS 2 a", "ERR The `numfields` parameter must match the number of arguments"},
+	}
+	for _, tt := range tests {
+		args := strings.Fields(tt.args)
+		if got := command(db, args[0], args[1:]...); got.Typ != "error" || got.Str != tt.want {
+			t.Errorf("%s = %v, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+// Deadlines are logged as an absolute HPEXPIREAT, and fields deleted because
+// theirs had passed as an HDEL.
+func TestHexpireLogged(t *testing.T) {
+	db := newHashWith("a", "b", "c")
+	deadline := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	tests := []struct {
+		args string
+		want []string
+	}{
+		{"HPEXPIREAT hash " + deadline + " FIELDS 3 a b missing", []string{"HPEXPIREAT hash " + deadline + " FIELDS 2 a b"}},
+		{"HPEXPIREAT hash " + deadline + " NX FIELDS 2 a b", nil},
+		{"HEXPIRE hash 0 FIELDS 2 a c", []string{"HDEL hash a c"}},
+		{"HPERSIST hash FIELDS 2 b c", []string{"HPERSIST hash FIELDS 2 b c"}},
+		{"HPERSIST hash FIELDS 1 b", nil},
+	}
+	for _, tt := range tests {
+		args := strings.Fields(tt.args)
+		if got := logged(db, args[0], args[1:]...); !slices.Equal(got, tt.want) {
+			t.Errorf("%s logged %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
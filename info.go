@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// Counters reported by INFO stats.
+var stats struct {
+	expiredKeys           atomic.Int64 // Keys removed because their deadline passed
+	expiredFields         atomic.Int64 // Hash fields removed because their deadline passed
+	expiredTimeCapReached atomic.Int64 // Expiry cycles stopped by their time limit
+}
+
+// Sections of the INFO reply, in the order they are listed.
+var infoSections = []struct {
+	name string
+	fn   func(s *Server, b *strings.Builder)
+}{
+	{"server", infoServer},
+	{"persistence", infoPersistence},
+	{"stats", infoStats},
+	{"keyspace", infoKeyspace},
+}
+
+// info implements INFO [section ...]. Without a section, or with "all",
+// "default" or "everything", every section is included.
+func info(client *Client, args []resp.Value) resp.Value {
+	wanted := make(map[string]bool)
+	for _, arg := range args {
+		wanted[strings.ToLower(arg.Bulk)] = true
+	}
+	all := len(wanted) == 0 || wanted["all"] || wanted["default"] || wanted["everything"]
+
+	var b strings.Builder
+	for _, section := range infoSections {
+		if !all && !wanted[section.name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", strings.ToUpper(section.name[:1])+section.name[1:])
+		section.fn(client.server, &b)
+	}
+	return resp.Value{Typ: "verbatim", Format: "txt", Bulk: b.String()}
+}
+
+func infoServer(s *Server, b *strings.Builder) {
+	config.mu.RLock()
+	port := config.port
+	config.mu.RUnlock()
+
+	fmt.Fprintf(b, "bluedis_version:%s\r\n", version)
+	fmt.Fprintf(b, "redis_mode:standalone\r\n")
+	fmt.Fprintf(b, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(b, "tcp_port:%d\r\n", port)
+	fmt.Fprintf(b, "uptime_in_seconds:%d\r\n", int64(time.Since(s.started).Seconds()))
+}
+
+func infoPersistence(s *Server, b *strings.Builder) {
+	s.saveMu.Lock()
+	saving, lastSave, lastSaveOK := s.saving, s.lastSave, s.lastSaveOK
+	s.saveMu.Unlock()
+
+	status := "ok"
+	if !lastSaveOK {
+		status = "err"
+	}
+	fmt.Fprintf(b, "rdb_changes_since_last_save:%d\r\n", s.dirty.Load())
+	fmt.Fprintf(b, "rdb_bgsave_in_progress:%d\r\n", boolInt(saving))
+	fmt.Fprintf(b, "rdb_last_save_time:%d\r\n", lastSave.Unix())
+	fmt.Fprintf(b, "rdb_last_bgsave_status:%s\r\n", status)
+	fmt.Fprintf(b, "aof_enabled:%d\r\n", boolInt(s.aof != nil))
+	fmt.Fprintf(b, "aof_rewrite_in_progress:%d\r\n", boolInt(s.aof != nil && s.aof.Rewriting()))
+}
+
+func infoStats(s *Server, b *strings.Builder) {
+	fmt.Fprintf(b, "expired_keys:%d\r\n", stats.expiredKeys.Load())
+	fmt.Fprintf(b, "expired_subkeys:%d\r\n", stats.expiredFields.Load())
+	fmt.Fprintf(b, "expired_time_cap_reached_count:%d\r\n", stats.expiredTimeCapReached.Load())
+}
+
+func infoKeyspace(s *Server, b *strings.Builder) {
+	keyspaceMu.RLock()
+	defer keyspaceMu.RUnlock()
+	for _, db := range databases {
+		if db.len() > 0 {
+			fmt.Fprintf(b, "db%d:keys=%d,expires=%d,subexpiry=%d\r\n", db.id, db.len(), db.expires.len(), db.hexpires.len())
+		}
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
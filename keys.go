@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// Commands that work on keys whatever the type of their value.
+
+func typeHandler(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'type' command"}
+	}
+
+	keyspaceMu.RLock()
+	defer keyspaceMu.RUnlock()
+	obj := db.lookupKey(args[0].Bulk)
+	if obj == nil {
+		return resp.Value{Typ: "string", Str: "none"}
+	}
+	return resp.Value{Typ: "string", Str: obj.Type}
+}
+
+// exists counts how many of the given keys exist. A key given twice is counted
+// twice, like Redis does.
+func exists(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'exists' command"}
+	}
+	return resp.Value{Typ: "integer", Num: countKeys(db, args)}
+}
+
+// touch is EXISTS for clients that use it to mark keys as accessed. Bluedis
+// does not track access times, so counting the keys is all there is to do.
+func touch(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'touch' command"}
+	}
+	return resp.Value{Typ: "integer", Num: countKeys(db, args)}
+}
+
+func countKeys(db *Keyspace, keys []resp.Value) int {
+	keyspaceMu.RLock()
+	defer keyspaceMu.RUnlock()
+
+	count := 0
+	for _, key := range keys {
+		if db.lookupKey(key.Bulk) != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// unlink is DEL under the name Redis gives to its non blocking variant. Memory
+// is given back by the garbage collector either way.
+func unlink(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'unlink' command"}
+	}
+	return Delete(db, args)
+}
+
+// rename moves the value of a key, deadline included, to another key, which is
+// overwritten whatever it held.
+func rename(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'rename' command"}
+	}
+	return renameKey(db, args[0].Bulk, args[1].Bulk, false)
+}
+
+// renamenx is RENAME that only happens when the new key does not exist yet.
+func renamenx(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'renamenx' command"}
+	}
+	return renameKey(db, args[0].Bulk, args[1].Bulk, true)
+}
+
+func renameKey(db *Keyspace, src, dst string, nx bool) resp.Value {
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	obj := db.lookupKeyWrite(src)
+	if obj == nil {
+		return resp.Value{Typ: "error", Str: "ERR no such key"}
+	}
+	if nx {
+		if db.lookupKeyWrite(dst) != nil {
+			return resp.Value{Typ: "integer", Num: 0}
+		}
+	} else if src == dst {
+		return resp.Value{Typ: "string", Str: "OK"}
+	}
+
+	db.delete(src)
+	db.set(dst, obj)
+
+	if nx {
+		return resp.Value{Typ: "integer", Num: 1}
+	}
+	return resp.Value{Typ: "string", Str: "OK"}
+}
+
+// copyHandler implements COPY source destination [REPLACE]. The copy gets the
+// deadline of the source, if any.
+func copyHandler(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'copy' command"}
+	}
+
+	src, dst := args[0].Bulk, args[1].Bulk
+	replace := false
+	for _, arg := range args[2:] {
+		if strings.ToUpper(arg.Bulk) != "REPLACE" {
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+		replace = true
+	}
+	if src == dst {
+		return resp.Value{Typ: "error", Str: "ERR source and destination objects are the same"}
+	}
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	obj := db.lookupKeyWrite(src)
+	if obj == nil {
+		return resp.Value{Typ: "integer", Num: 0}
+	}
+	if db.lookupKeyWrite(dst) != nil && !replace {
+		return resp.Value{Typ: "integer", Num: 0}
+	}
+
+	db.set(dst, obj.copy())
+	return resp.Value{Typ: "integer", Num: 1}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"iter"
+	"sync"
+	"time"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// Types of the values a key can hold, named the way Redis reports them.
+const (
+	typeString = "string"
+	typeHash   = "hash"
+	typeList   = "list"
+)
+
+// Object is the value stored under a key. Only the field matching Type is
+// used. Any type of key can expire, and so can the fields of a hash.
+type Object struct {
+	Type         string
+	Content      string               // Value of a string
+	Hash         *dict[string]        // Fields of a hash
+	FieldExpires map[string]time.Time // Deadlines of the fields of a hash that have one
+	List         *DoublyLinkedList    // Elements of a list
+	Begone       time.Time
+	HasExpiry    bool
+}
+
+// Keyspace is one of the numbered databases. It holds every key whatever its
+// type, so a key names a single value: using it with a command meant for
+// another type fails with WRONGTYPE instead of creating a second value next to
+// the first one.
+type Keyspace struct {
+	id       int            // Index of the database, what SELECT takes
+	keys     *dict[*Object] // Every key of the database
+	expires  *dict[*Object] // The keys that have a deadline
+	hexpires *dict[*Object] // The hashes some fields of which have a deadline
+}
+
+func newKeyspace(id int) *Keyspace {
+	ks := &Keyspace{id: id}
+	ks.flush()
+	return ks
+}
+
+// flush removes every key.
+func (ks *Keyspace) flush() {
+	ks.keys = newDict[*Object]()
+	ks.expires = newDict[*Object]()
+	ks.hexpires = newDict[*Object]()
+}
+
+// swap exchanges the keys of two databases, each keeping its index.
+func (ks *Keyspace) swap(other *Keyspace) {
+	ks.keys, other.keys = other.keys, ks.keys
+	ks.expires, other.expires = other.expires, ks.expires
+	ks.hexpires, other.hexpires = other.hexpires, ks.hexpires
+}
+
+func (ks *Keyspace) get(key string) (*Object, bool) {
+	return ks.keys.get(key)
+}
+
+// set stores obj at key, replacing whatever was there, deadline included.
+func (ks *Keyspace) set(key string, obj *Object) {
+	ks.keys.set(key, obj)
+	if obj.HasExpiry {
+		ks.expires.set(key, obj)
+	} else {
+		ks.expires.delete(key)
+	}
+	if len(obj.FieldExpires) > 0 {
+		ks.hexpires.set(key, obj)
+	} else {
+		ks.hexpires.delete(key)
+	}
+}
+
+func (ks *Keyspace) delete(key string) bool {
+	ks.expires.delete(key)
+	ks.hexpires.delete(key)
+	return ks.keys.delete(key)
+}
+
+func (ks *Keyspace) len() int {
+	return ks.keys.len()
+}
+
+func (ks *Keyspace) all() iter.Seq2[string, *Object] {
+	return ks.keys.all()
+}
+
+// setExpiry gives the object stored at key a deadline.
+func (ks *Keyspace) setExpiry(key string, obj *Object, deadline time.Time) {
+	obj.HasExpiry = true
+	obj.Begone = deadline
+	ks.expires.set(key, obj)
+}
+
+// persist removes the deadline of the object stored at key.
+func (ks *Keyspace) persist(key string, obj *Object) {
+	obj.HasExpiry = false
+	obj.Begone = time.Time{}
+	ks.expires.delete(key)
+}
+
+// setFieldExpiry gives a field of the hash stored at key a deadline.
+func (ks *Keyspace) setFieldExpiry(key string, obj *Object, field string, deadline time.Time) {
+	if obj.FieldExpires == nil {
+		obj.FieldExpires = make(map[string]time.Time)
+	}
+	obj.FieldExpires[field] = deadline
+	ks.hexpires.set(key, obj)
+}
+
+// persistField removes the deadline of a field of the hash stored at key. It
+// reports whether the field had one.
+func (ks *Keyspace) persistField(key string, obj *Object, field string) bool {
+	if _, ok := obj.FieldExpires[field]; !ok {
+		return false
+	}
+	delete(obj.FieldExpires, field)
+	if len(obj.FieldExpires) == 0 {
+		obj.FieldExpires = nil
+		ks.hexpires.delete(key)
+	}
+	return true
+}
+
+// deleteField removes a field of the hash stored at key, and the key with the
+// last field. It reports whether the field was there.
+func (ks *Keyspace) deleteField(key string, obj *Object, field string) bool {
+	if !obj.Hash.delete(field) {
+		return false
+	}
+	ks.persistField(key, obj, field)
+	if obj.Hash.len() == 0 {
+		ks.delete(key)
+	}
+	return true
+}
+
+// databases holds the databases, as many as the databases parameter asks for.
+// Clients start on database 0 and move to another one with SELECT.
+var databases []*Keyspace
+
+// initDatabases creates n empty databases.
+func initDatabases(n int) {
+	databases = make([]*Keyspace, n)
+	for i := range databases {
+		databases[i] = newKeyspace(i)
+	}
+}
+
+// keyspaceMu protects every database and the objects in them. Write commands
+// hold it for writing while they run, read commands for reading.
+var keyspaceMu sync.RWMutex
+
+var wrongType = resp.Value{Typ: "error", Str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+
+func newString(content string) *Object {
+	return &Object{Type: typeString, Content: content}
+}
+
+func newHash() *Object {
+	return &Object{Type: typeHash, Hash: newDict[string]()}
+}
+
+func newList() *Object {
+	return &Object{Type: typeList, List: NewDoublyLinkedList()}
+}
+
+// expired reports whether the deadline of the object has passed. Nothing
+// expires while the AOF is replayed: the commands that follow were applied to
+// the key while it still existed, and must find it again to end up with the
+// same result. Keys past their deadline disappear once loading is over.
+func (obj *Object) expired(now time.Time) bool {
+	return obj.HasExpiry && now.After(obj.Begone) && !loading
+}
+
+// fieldExpired reports whether the deadline of a field of a hash has passed.
+// Like keys, fields do not expire while the AOF is replayed.
+func (obj *Object) fieldExpired(field string, now time.Time) bool {
+	deadline, ok := obj.FieldExpires[field]
+	return ok && now.After(deadline) && !loading
+}
+
+// elements returns the elements of a list, head first.
+func (obj *Object) elements() []string {
+	values := obj.List.ExtractRange(0, -1)
+	elements := make([]string, len(values))
+	for i, v := range values {
+		elements[i] = fmt.Sprintf("%v", v)
+	}
+	return elements
+}
+
+// copy returns a deep copy of the object, one that later changes to the
+// original do not affect. Fields of a hash that expired are left out.
+func (obj *Object) copy() *Object {
+	dup := *obj
+	switch obj.Type {
+	case typeHash:
+		now := time.Now()
+		dup.Hash = newDict[string]()
+		dup.FieldExpires = nil
+		for field, value := range obj.Hash.all() {
+			if obj.fieldExpired(field, now) {
+				continue
+			}
+			dup.Hash.set(field, value)
+			if deadline, ok := obj.FieldExpires[field]; ok {
+				if dup.FieldExpires == nil {
+					dup.FieldExpires = make(map[string]time.Time)
+				}
+				dup.FieldExpires[field] = deadline
+			}
+		}
+	case typeList:
+		dup.List = NewDoublyLinkedList()
+		for _, element := range obj.elements() {
+			dup.List.PushRight(element)
+		}
+	}
+	return &dup
+}
+
+// lookupKey returns the object stored at key, nil when there is none. Keys
+// whose deadline passed are reported missing but left in place, since the
+// caller may only hold keyspaceMu for reading.
+func (ks *Keyspace) lookupKey(key string) *Object {
+	obj, ok := ks.get(key)
+	if !ok || obj.expired(time.Now()) {
+		return nil
+	}
+	return obj
+}
+
+// lookupKeyWrite is lookupKey for write commands, which hold keyspaceMu for
+// writing. A key found expired is removed for good, and recorded in
+// expiredKeys.
+func (ks *Keyspace) lookupKeyWrite(key string) *Object {
+	obj, ok := ks.get(key)
+	if !ok {
+		return nil
+	}
+	if obj.expired(time.Now()) {
+		ks.delete(key)
+		expiredKeys = append(expiredKeys, expiredKey{ks.id, key})
+		return nil
+	}
+	return obj
+}
+
+// expiredKey is a key removed from database db because it expired.
+type expiredKey struct {
+	db  int
+	key string
+}
+
+// expiredKeys lists the keys the running write command removed because they
+// expired. Their deletion is logged to the AOF ahead of the command, otherwise
+// the command would find them again when replayed, since nothing expires while
+// loading. Only used with writeMu held.
+var expiredKeys []expiredKey
+
+// takeExpiredKeys returns and clears expiredKeys.
+func takeExpiredKeys() []expiredKey {
+	keys := expiredKeys
+	expiredKeys = nil
+	return keys
+}
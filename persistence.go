@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	appendonly "github.com/IAmRiteshKoushik/bluedis/aof"
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// loading is set while the AOF is being replayed at startup, before any client
+// can connect. Deadlines that already passed are left alone while it is set:
+// the AOF goes on to say what became of those keys.
+var loading bool
+
+// LoadAOF rebuilds the dataset by feeding every command stored in the AOF to
+// the same handler a client would reach, on the database the last SELECT
+// before it picked. Entries that are not write commands Bluedis knows about
+// are skipped and reported.
+func (s *Server) LoadAOF() error {
+	loading = true
+	defer func() { loading = false }()
+
+	start := time.Now()
+	loaded, unknown := 0, 0
+	db := databases[0]
+	var selectErr error
+
+	err := s.aof.Read(func(value resp.Value) {
+		if selectErr != nil {
+			return
+		}
+		if value.Typ != "array" || len(value.Array) == 0 {
+			fmt.Println("Skipping invalid entry in AOF, expected a non-empty array")
+			unknown++
+			return
+		}
+
+		command := strings.ToUpper(value.Array[0].Bulk)
+		args := value.Array[1:]
+
+		if command == "SELECT" && len(args) == 1 {
+			index, errValue := parseDB(args[0])
+			if errValue != nil {
+				selectErr = fmt.Errorf("Can't select database %s from the AOF, %d databases are configured", args[0].Bulk, len(databases))
+				return
+			}
+			db = databases[index]
+			return
+		}
+
+		handler, ok := Handlers[command]
+		if !ok || !writeCommands[command] {
+			fmt.Printf("Skipping unknown command '%s' in AOF\n", command)
+			unknown++
+			return
+		}
+
+		writeMu.Lock()
+		result := handler(db, args)
+		writeMu.Unlock()
+
+		if result.Typ == "error" {
+			fmt.Printf("Error replaying '%s' from AOF: %s\n", command, result.Str)
+		}
+		loaded++
+	})
+	if selectErr != nil {
+		return selectErr
+	}
+	var truncated *appendonly.TruncatedError
+	if errors.As(err, &truncated) {
+		// The server most likely died while appending the last command
+		config.mu.RLock()
+		loadTruncated := config.aofLoadTruncated
+		config.mu.RUnlock()
+		if !loadTruncated {
+			return fmt.Errorf("Unexpected end of file reading the append only file %s (%v). You can: "+
+				"1) Make a backup of your AOF file, then use ./bluedis-check-aof --fix <filename>. "+
+				"2) Set 'aof-load-truncated yes' and restart the server", truncated.File, err)
+		}
+		fmt.Printf("!!! Warning: short read while loading the AOF file %s !!!\n", truncated.File)
+		fmt.Printf("!!! Truncating the AOF at offset %d !!!\n", truncated.Offset)
+		if err := s.aof.Truncate(truncated.Offset); err != nil {
+			return fmt.Errorf("Error truncating the AOF file: %v", err)
+		}
+		fmt.Println("AOF loaded anyway because aof-load-truncated is enabled")
+		err = nil
+	}
+	var corrupt *appendonly.CorruptError
+	if errors.As(err, &corrupt) {
+		return fmt.Errorf("Bad file format reading the append only file %s: make a backup of your AOF file, "+
+			"then use ./bluedis-check-aof --fix <filename>. Valid commands end at offset %d: %v",
+			corrupt.File, corrupt.Offset, corrupt.Err)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("DB loaded from append only file: %d commands in %.3f seconds", loaded, time.Since(start).Seconds())
+	if unknown > 0 {
+		fmt.Printf(", %d unknown entries skipped", unknown)
+	}
+	fmt.Println()
+	return nil
+}
+
+var ErrSaveInProgress = errors.New("ERR Background save already in progress")
+
+// LoadData rebuilds the dataset at startup. The AOF has the most recent data
+// so it wins when it is enabled and not empty, otherwise the snapshot is
+// loaded if there is one.
+func (s *Server) LoadData() error {
+	if s.aof != nil {
+		if current, _ := s.aof.Size(); current > 0 {
+			return s.LoadAOF()
+		}
+	}
+
+	config.mu.RLock()
+	path := config.dbFilename
+	config.mu.RUnlock()
+
+	start := time.Now()
+	ds, err := loadSnapshot(path)
+	if err != nil {
+		return fmt.Errorf("Error loading the snapshot %s: %v", path, err)
+	}
+	if ds == nil {
+		return nil
+	}
+	if err := ds.restore(); err != nil {
+		return fmt.Errorf("Error loading the snapshot %s: %v", path, err)
+	}
+	fmt.Printf("DB loaded from snapshot: %d keys in %.3f seconds\n", ds.size(), time.Since(start).Seconds())
+
+	// The AOF is empty so far, it needs the loaded data as its starting point
+	// or it would lose it on the next restart
+	if s.aof != nil && ds.size() > 0 {
+		return s.BackgroundRewriteAOF()
+	}
+	return nil
+}
+
+// Save writes a snapshot of the dataset and waits for it to be on disk.
+func (s *Server) Save() error {
+	ds, dirty, err := s.startSave()
+	if err != nil {
+		return err
+	}
+	return s.finishSave(ds, dirty)
+}
+
+// BackgroundSave takes a copy of the dataset and writes the snapshot from a
+// goroutine, so that clients are only held up while the copy is made.
+func (s *Server) BackgroundSave() error {
+	ds, dirty, err := s.startSave()
+	if err != nil {
+		return err
+	}
+
+	s.bgsaves.Add(1)
+	go func() {
+		defer s.bgsaves.Done()
+		start := time.Now()
+		if err := s.finishSave(ds, dirty); err != nil {
+			fmt.Println("Background saving error:", err)
+			return
+		}
+		fmt.Printf("Background saving terminated with success in %.3f seconds\n", time.Since(start).Seconds())
+	}()
+	return nil
+}
+
+// startSave marks a save as in progress and copies the dataset along with the
+// number of changes it includes.
+func (s *Server) startSave() (*Dataset, int64, error) {
+	s.saveMu.Lock()
+	if s.saving {
+		s.saveMu.Unlock()
+		return nil, 0, ErrSaveInProgress
+	}
+	s.saving = true
+	s.saveMu.Unlock()
+
+	writeMu.Lock()
+	ds := copyDataset()
+	dirty := s.dirty.Load()
+	writeMu.Unlock()
+
+	return ds, dirty, nil
+}
+
+func (s *Server) finishSave(ds *Dataset, dirty int64) error {
+	config.mu.RLock()
+	path, format := config.dbFilename, config.snapshotFormat
+	config.mu.RUnlock()
+
+	err := saveSnapshot(ds, path, format)
+
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.saving = false
+	s.lastTry = time.Now()
+	s.lastSaveOK = err == nil
+	if err == nil {
+		s.lastSave = s.lastTry
+		// Changes made while saving are not in the snapshot and still count
+		s.dirty.Add(-dirty)
+	}
+	return err
+}
+
+// saveIfNeeded starts a background save when one of the save rules is met. A
+// failed save is only retried after a few seconds.
+func (s *Server) saveIfNeeded() {
+	config.mu.RLock()
+	rules := config.saveRules
+	config.mu.RUnlock()
+
+	s.saveMu.Lock()
+	saving, lastSave, lastSaveOK, lastTry := s.saving, s.lastSave, s.lastSaveOK, s.lastTry
+	s.saveMu.Unlock()
+	if saving || (!lastSaveOK && time.Since(lastTry) < 5*time.Second) {
+		return
+	}
+
+	dirty := s.dirty.Load()
+	for _, rule := range rules {
+		if dirty >= int64(rule.changes) && time.Since(lastSave) >= time.Duration(rule.seconds)*time.Second {
+			fmt.Printf("%d changes in %d seconds. Saving...\n", rule.changes, rule.seconds)
+			if err := s.BackgroundSave(); err != nil && err != ErrSaveInProgress {
+				fmt.Println(err)
+			}
+			return
+		}
+	}
+}
+
+// SaveOnShutdown writes a final snapshot when save rules are configured, once
+// any background save still running has finished.
+func (s *Server) SaveOnShutdown() {
+	config.mu.RLock()
+	rules := len(config.saveRules)
+	config.mu.RUnlock()
+
+	s.bgsaves.Wait()
+	if rules == 0 {
+		return
+	}
+
+	fmt.Println("Saving the final snapshot before exiting.")
+	if err := s.Save(); err != nil {
+		fmt.Println("Error trying to save the DB, can't exit:", err)
+		return
+	}
+	fmt.Println("DB saved on disk")
+}
+
+func save(client *Client, args []resp.Value) resp.Value {
+	if len(args) != 0 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'save' command"}
+	}
+	if err := client.server.Save(); err != nil {
+		if err == ErrSaveInProgress {
+			return resp.Value{Typ: "error", Str: err.Error()}
+		}
+		return resp.Value{Typ: "error", Str: "ERR " + err.Error()}
+	}
+	return resp.Value{Typ: "string", Str: "OK"}
+}
+
+func bgsave(client *Client, args []resp.Value) resp.Value {
+	if len(args) != 0 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'bgsave' command"}
+	}
+	if err := client.server.BackgroundSave(); err != nil {
+		return resp.Value{Typ: "error", Str: err.Error()}
+	}
+	return resp.Value{Typ: "string", Str: "Background saving started"}
+}
+
+// lastsave returns the unix time of the last successful save.
+func lastsave(client *Client, args []resp.Value) resp.Value {
+	if len(args) != 0 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'lastsave' command"}
+	}
+	client.server.saveMu.Lock()
+	defer client.server.saveMu.Unlock()
+	return resp.Value{Typ: "integer", Num: int(client.server.lastSave.Unix())}
+}
@@ -0,0 +1,863 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// Redis RDB files. ReadRDB understands every version up to the one written by
+// Redis 7.4, and WriteRDB writes version 9 which any Redis since 5.0 loads.
+//
+//	"REDIS" <version: 4 ASCII digits>
+//	opcodes (aux fields, database selectors, ...) and key/value pairs
+//	0xFF <CRC64 (Jones) of everything above: 8 bytes, little endian>
+//
+// Lengths use a variable size encoding whose special form also marks strings
+// stored as integers or compressed with LZF. Small collections are stored as a
+// single string holding a ziplist, listpack, intset or zipmap.
+const (
+	rdbMagic        = "REDIS"
+	rdbVersion      = 9
+	rdbMaxVersion   = 12
+	rdbFirstWithCRC = 5
+
+	rdbOpSlotInfo     = 0xF4
+	rdbOpFunction2    = 0xF5
+	rdbOpFunctionPre  = 0xF6
+	rdbOpModuleAux    = 0xF7
+	rdbOpIdle         = 0xF8
+	rdbOpFreq         = 0xF9
+	rdbOpAux          = 0xFA
+	rdbOpResizeDB     = 0xFB
+	rdbOpExpireTimeMs = 0xFC
+	rdbOpExpireTime   = 0xFD
+	rdbOpSelectDB     = 0xFE
+	rdbOpEOF          = 0xFF
+
+	rdbTypeString         = 0
+	rdbTypeList           = 1
+	rdbTypeSet            = 2
+	rdbTypeZset           = 3
+	rdbTypeHash           = 4
+	rdbTypeZset2          = 5
+	rdbTypeHashZipmap     = 9
+	rdbTypeListZiplist    = 10
+	rdbTypeSetIntset      = 11
+	rdbTypeZsetZiplist    = 12
+	rdbTypeHashZiplist    = 13
+	rdbTypeListQuicklist  = 14
+	rdbTypeHashListpack   = 16
+	rdbTypeZsetListpack   = 17
+	rdbTypeListQuicklist2 = 18
+	rdbTypeSetListpack    = 20
+
+	// Special string encodings, flagged by the top two bits of the length
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+
+	// Kinds of quicklist nodes in RDB_TYPE_LIST_QUICKLIST_2
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+)
+
+// Redis checksums RDB files with the Jones CRC64, which is not one of the
+// polynomials hash/crc64 offers and has no initial or final inversion.
+var rdbCRCTable = func() (table [256]uint64) {
+	const poly = 0x95ac9329ac4bc9b5
+	for i := range table {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func rdbCRC(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = rdbCRCTable[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
+
+// ReadRDB decodes a Redis RDB file. Strings, hashes and lists are loaded
+// whatever their encoding, each into the database it was saved from. Bluedis
+// has no sets or sorted sets so those keys are read and left out, and so are
+// keys whose deadline already passed.
+func ReadRDB(r io.Reader) (*Dataset, error) {
+	rr := &rdbReader{r: bufio.NewReader(r)}
+	ds := newDataset()
+
+	header := rr.read(len(rdbMagic) + 4)
+	if rr.err != nil {
+		return nil, rr.err
+	}
+	if string(header[:len(rdbMagic)]) != rdbMagic {
+		return nil, errors.New("wrong signature, not a Redis RDB file")
+	}
+	version, err := strconv.Atoi(string(header[len(rdbMagic):]))
+	if err != nil || version < 1 || version > rdbMaxVersion {
+		return nil, fmt.Errorf("can't handle RDB format version %s", header[len(rdbMagic):])
+	}
+
+	var db uint64
+	var deadline time.Time
+	skipped := make(map[string]int)
+	now := time.Now()
+	for {
+		typ := rr.readByte()
+		if rr.err != nil {
+			return nil, rr.err
+		}
+
+		switch typ {
+		case rdbOpEOF:
+			sum := rr.crc
+			if version >= rdbFirstWithCRC {
+				footer := rr.read(8)
+				if rr.err != nil {
+					return nil, fmt.Errorf("missing checksum: %w", rr.err)
+				}
+				// Redis writes a zero checksum when rdbchecksum is off
+				if expected := binary.LittleEndian.Uint64(footer); expected != 0 && expected != sum {
+					return nil, errors.New("wrong checksum, the RDB file is corrupted")
+				}
+			}
+			for kind, n := range skipped {
+				fmt.Printf("Skipped %d %s while loading the RDB file\n", n, kind)
+			}
+			return ds, nil
+		case rdbOpSelectDB:
+			db, _ = rr.readLength()
+			if db > math.MaxInt32 {
+				return nil, fmt.Errorf("invalid database index %d", db)
+			}
+			continue
+		case rdbOpResizeDB:
+			rr.readLength()
+			rr.readLength()
+			continue
+		case rdbOpSlotInfo:
+			rr.readLength()
+			rr.readLength()
+			rr.readLength()
+			continue
+		case rdbOpAux:
+			rr.readString()
+			rr.readString()
+			continue
+		case rdbOpFunction2:
+			rr.readString()
+			continue
+		case rdbOpIdle:
+			rr.readLength()
+			continue
+		case rdbOpFreq:
+			rr.readByte()
+			continue
+		case rdbOpExpireTimeMs:
+			deadline = time.UnixMilli(int64(binary.LittleEndian.Uint64(rr.read(8))))
+			continue
+		case rdbOpExpireTime:
+			deadline = time.Unix(int64(binary.LittleEndian.Uint32(rr.read(4))), 0)
+			continue
+		case rdbOpModuleAux, rdbOpFunctionPre:
+			return nil, fmt.Errorf("can't load module data or functions (opcode 0x%X)", typ)
+		}
+
+		key := rr.readString()
+		kind, value, err := rr.readObject(typ)
+		if rr.err != nil {
+			err = rr.err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key '%s': %w", key, err)
+		}
+
+		var obj *Object
+		expired := !deadline.IsZero() && !now.Before(deadline)
+		switch {
+		case expired:
+			// Dead keys are dropped, like a Redis primary does on load
+		case kind == "string":
+			obj = newString(value.(string))
+		case kind == "hash":
+			if hash := value.(map[string]string); len(hash) > 0 {
+				obj = newHash()
+				for field, value := range hash {
+					obj.Hash.set(field, value)
+				}
+			}
+		case kind == "list":
+			if elements := value.([]string); len(elements) > 0 {
+				obj = newList()
+				for _, element := range elements {
+					obj.List.PushRight(element)
+				}
+			}
+		default:
+			skipped[kind+" keys"]++
+		}
+		if obj != nil {
+			if !deadline.IsZero() {
+				obj.HasExpiry = true
+				obj.Begone = deadline
+			}
+			ds.db(int(db))[key] = obj
+		}
+		deadline = time.Time{}
+	}
+}
+
+// readObject reads the value of a key stored with the given type. The value
+// is a string, a map[string]string for hashes or a []string for lists; sets
+// and sorted sets are read to get past them but only their kind is returned.
+func (rr *rdbReader) readObject(typ byte) (kind string, value any, err error) {
+	switch typ {
+	case rdbTypeString:
+		return "string", rr.readString(), nil
+
+	case rdbTypeList:
+		n, _ := rr.readLength()
+		var elements []string
+		for i := uint64(0); i < n && rr.err == nil; i++ {
+			elements = append(elements, rr.readString())
+		}
+		return "list", elements, nil
+	case rdbTypeListZiplist:
+		elements, err := ziplistEntries([]byte(rr.readString()))
+		return "list", elements, err
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		n, _ := rr.readLength()
+		var elements []string
+		for i := uint64(0); i < n && rr.err == nil; i++ {
+			container := uint64(quicklistNodePacked)
+			if typ == rdbTypeListQuicklist2 {
+				container, _ = rr.readLength()
+			}
+			node := []byte(rr.readString())
+			var entries []string
+			var err error
+			switch {
+			case typ == rdbTypeListQuicklist:
+				entries, err = ziplistEntries(node)
+			case container == quicklistNodePlain:
+				entries = []string{string(node)}
+			case container == quicklistNodePacked:
+				entries, err = listpackEntries(node)
+			default:
+				err = fmt.Errorf("unknown quicklist node container %d", container)
+			}
+			if err != nil {
+				return "", nil, err
+			}
+			elements = append(elements, entries...)
+		}
+		return "list", elements, nil
+
+	case rdbTypeHash:
+		n, _ := rr.readLength()
+		hash := make(map[string]string)
+		for i := uint64(0); i < n && rr.err == nil; i++ {
+			field := rr.readString()
+			hash[field] = rr.readString()
+		}
+		return "hash", hash, nil
+	case rdbTypeHashZipmap, rdbTypeHashZiplist, rdbTypeHashListpack:
+		blob := []byte(rr.readString())
+		var entries []string
+		var err error
+		switch typ {
+		case rdbTypeHashZipmap:
+			entries, err = zipmapEntries(blob)
+		case rdbTypeHashZiplist:
+			entries, err = ziplistEntries(blob)
+		default:
+			entries, err = listpackEntries(blob)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if len(entries)%2 != 0 {
+			return "", nil, errors.New("hash with a field but no value")
+		}
+		hash := make(map[string]string, len(entries)/2)
+		for i := 0; i < len(entries); i += 2 {
+			hash[entries[i]] = entries[i+1]
+		}
+		return "hash", hash, nil
+
+	case rdbTypeSet:
+		n, _ := rr.readLength()
+		for i := uint64(0); i < n && rr.err == nil; i++ {
+			rr.readString()
+		}
+		return "set", nil, nil
+	case rdbTypeSetIntset:
+		_, err := intsetEntries([]byte(rr.readString()))
+		return "set", nil, err
+	case rdbTypeSetListpack:
+		_, err := listpackEntries([]byte(rr.readString()))
+		return "set", nil, err
+
+	case rdbTypeZset, rdbTypeZset2:
+		n, _ := rr.readLength()
+		for i := uint64(0); i < n && rr.err == nil; i++ {
+			rr.readString()
+			if typ == rdbTypeZset2 {
+				rr.read(8)
+				continue
+			}
+			// Old scores are a length byte and the score as text, with
+			// 253, 254 and 255 standing for NaN, +inf and -inf
+			if size := rr.readByte(); size < 253 {
+				rr.read(int(size))
+			}
+		}
+		return "sorted set", nil, nil
+	case rdbTypeZsetZiplist:
+		_, err := ziplistEntries([]byte(rr.readString()))
+		return "sorted set", nil, err
+	case rdbTypeZsetListpack:
+		_, err := listpackEntries([]byte(rr.readString()))
+		return "sorted set", nil, err
+	}
+
+	// Streams, modules and hashes with field expiration
+	return "", nil, fmt.Errorf("value type %d is not supported", typ)
+}
+
+// WriteRDB encodes the dataset as a Redis RDB file. Version 9 has no room for
+// the deadlines of hash fields, so those fields are saved without one.
+func (ds *Dataset) WriteRDB(w io.Writer) error {
+	rw := &rdbWriter{w: bufio.NewWriter(w)}
+
+	rw.write([]byte(fmt.Sprintf("%s%04d", rdbMagic, rdbVersion)))
+	rw.writeAux("redis-bits", "64")
+	rw.writeAux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	rw.writeAux("bluedis-ver", version)
+
+	fieldExpires := 0
+	for _, i := range ds.indexes() {
+		fieldExpires += rw.writeDB(i, ds.dbs[i])
+	}
+	if fieldExpires > 0 {
+		fmt.Printf("Saved %d hash fields without their deadline to the RDB file\n", fieldExpires)
+	}
+
+	rw.writeByte(rdbOpEOF)
+	if rw.err != nil {
+		return rw.err
+	}
+	if _, err := rw.w.Write(binary.LittleEndian.AppendUint64(nil, rw.crc)); err != nil {
+		return err
+	}
+	return rw.w.Flush()
+}
+
+// writeDB writes the keys of database db. It returns the number of hash
+// fields whose deadline it could not save.
+func (rw *rdbWriter) writeDB(db int, keys map[string]*Object) int {
+	expires, fieldExpires := 0, 0
+	for _, obj := range keys {
+		if obj.HasExpiry {
+			expires++
+		}
+		fieldExpires += len(obj.FieldExpires)
+	}
+	rw.writeByte(rdbOpSelectDB)
+	rw.writeLength(uint64(db))
+	rw.writeByte(rdbOpResizeDB)
+	rw.writeLength(uint64(len(keys)))
+	rw.writeLength(uint64(expires))
+
+	for key, obj := range keys {
+		if obj.HasExpiry {
+			rw.writeByte(rdbOpExpireTimeMs)
+			rw.write(binary.LittleEndian.AppendUint64(nil, uint64(obj.Begone.UnixMilli())))
+		}
+		switch obj.Type {
+		case typeString:
+			rw.writeByte(rdbTypeString)
+			rw.writeString(key)
+			rw.writeString(obj.Content)
+		case typeHash:
+			rw.writeByte(rdbTypeHash)
+			rw.writeString(key)
+			rw.writeLength(uint64(obj.Hash.len()))
+			for field, value := range obj.Hash.all() {
+				rw.writeString(field)
+				rw.writeString(value)
+			}
+		case typeList:
+			elements := obj.elements()
+			rw.writeByte(rdbTypeList)
+			rw.writeString(key)
+			rw.writeLength(uint64(len(elements)))
+			for _, element := range elements {
+				rw.writeString(element)
+			}
+		}
+	}
+	return fieldExpires
+}
+
+// rdbReader keeps the first error, like the snapshot reader of package aof.
+// Failed reads of fixed size fields return zeroed bytes so that callers can
+// decode them without checking first.
+type rdbReader struct {
+	r   *bufio.Reader
+	crc uint64
+	err error
+}
+
+func (rr *rdbReader) read(n int) []byte {
+	if n > rdbReadChunk {
+		return rr.readLong(n)
+	}
+	b := make([]byte, n)
+	if rr.err != nil {
+		return b
+	}
+	if _, err := io.ReadFull(rr.r, b); err != nil {
+		rr.err = fmt.Errorf("unexpected end of RDB file: %w", err)
+		return b
+	}
+	rr.crc = rdbCRC(rr.crc, b)
+	return b
+}
+
+// rdbReadChunk is the largest read done in one go. Longer strings are read
+// as they arrive, so that a corrupted length does not cost more memory than
+// the file holds.
+const rdbReadChunk = 64 * 1024
+
+func (rr *rdbReader) readLong(n int) []byte {
+	if rr.err != nil {
+		return nil
+	}
+	var b bytes.Buffer
+	if _, err := io.CopyN(&b, rr.r, int64(n)); err != nil {
+		rr.err = fmt.Errorf("unexpected end of RDB file: %w", err)
+		return nil
+	}
+	rr.crc = rdbCRC(rr.crc, b.Bytes())
+	return b.Bytes()
+}
+
+func (rr *rdbReader) readByte() byte {
+	return rr.read(1)[0]
+}
+
+// readLength reads a length. When encoded is set the length is instead the
+// kind of special encoding of the string that follows.
+func (rr *rdbReader) readLength() (n uint64, encoded bool) {
+	b := rr.readByte()
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3F), false
+	case 1:
+		return uint64(b&0x3F)<<8 | uint64(rr.readByte()), false
+	case 2:
+		switch b {
+		case 0x80:
+			return uint64(binary.BigEndian.Uint32(rr.read(4))), false
+		case 0x81:
+			return binary.BigEndian.Uint64(rr.read(8)), false
+		}
+		if rr.err == nil {
+			rr.err = fmt.Errorf("invalid length encoding 0x%X", b)
+		}
+		return 0, false
+	default:
+		return uint64(b & 0x3F), true
+	}
+}
+
+func (rr *rdbReader) readString() string {
+	n, encoded := rr.readLength()
+	if encoded {
+		switch n {
+		case rdbEncInt8:
+			return strconv.FormatInt(leInt(rr.read(1)), 10)
+		case rdbEncInt16:
+			return strconv.FormatInt(leInt(rr.read(2)), 10)
+		case rdbEncInt32:
+			return strconv.FormatInt(leInt(rr.read(4)), 10)
+		case rdbEncLZF:
+			compressed, _ := rr.readLength()
+			size, _ := rr.readLength()
+			if rr.err == nil && (compressed > resp.MaxBulkSize || size > resp.MaxBulkSize) {
+				rr.err = errors.New("invalid string length in RDB file")
+			}
+			if rr.err != nil {
+				return ""
+			}
+			data, err := lzfDecompress(rr.read(int(compressed)), int(size))
+			if err != nil && rr.err == nil {
+				rr.err = err
+			}
+			return string(data)
+		}
+		if rr.err == nil {
+			rr.err = fmt.Errorf("unknown string encoding %d", n)
+		}
+		return ""
+	}
+
+	if rr.err == nil && n > resp.MaxBulkSize {
+		rr.err = errors.New("invalid string length in RDB file")
+	}
+	if rr.err != nil {
+		return ""
+	}
+	return string(rr.read(int(n)))
+}
+
+// rdbWriter is the writing counterpart of rdbReader.
+type rdbWriter struct {
+	w   *bufio.Writer
+	crc uint64
+	err error
+}
+
+func (rw *rdbWriter) write(b []byte) {
+	if rw.err != nil {
+		return
+	}
+	rw.crc = rdbCRC(rw.crc, b)
+	_, rw.err = rw.w.Write(b)
+}
+
+func (rw *rdbWriter) writeByte(b byte) {
+	rw.write([]byte{b})
+}
+
+func (rw *rdbWriter) writeLength(n uint64) {
+	switch {
+	case n < 1<<6:
+		rw.writeByte(byte(n))
+	case n < 1<<14:
+		rw.write([]byte{0x40 | byte(n>>8), byte(n)})
+	case n <= math.MaxUint32:
+		rw.write(binary.BigEndian.AppendUint32([]byte{0x80}, uint32(n)))
+	default:
+		rw.write(binary.BigEndian.AppendUint64([]byte{0x81}, n))
+	}
+}
+
+func (rw *rdbWriter) writeString(s string) {
+	rw.writeLength(uint64(len(s)))
+	rw.write([]byte(s))
+}
+
+func (rw *rdbWriter) writeAux(key, value string) {
+	rw.writeByte(rdbOpAux)
+	rw.writeString(key)
+	rw.writeString(value)
+}
+
+// leInt decodes a little endian two's complement integer of 1 to 8 bytes.
+func leInt(b []byte) int64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	shift := 64 - 8*len(b)
+	return int64(v<<shift) >> shift
+}
+
+var errBadEncoding = errors.New("corrupted ziplist, listpack, intset or zipmap")
+
+// ziplistEntries returns the entries of a ziplist, integers as text.
+//
+//	<zlbytes: 4> <zltail: 4> <zllen: 2> entries 0xFF
+//	entry: <prevlen: 1 or 0xFE + 4> <encoding> <data>
+func ziplistEntries(zl []byte) ([]string, error) {
+	var entries []string
+	pos := 10
+	for {
+		if pos >= len(zl) {
+			return nil, errBadEncoding
+		}
+		if zl[pos] == 0xFF {
+			return entries, nil
+		}
+
+		// The length of the previous entry only matters when walking backwards
+		if zl[pos] == 0xFE {
+			pos += 5
+		} else {
+			pos++
+		}
+		if pos >= len(zl) {
+			return nil, errBadEncoding
+		}
+
+		b := zl[pos]
+		header, n := 1, 0
+		switch b >> 6 {
+		case 0:
+			n = int(b & 0x3F)
+		case 1:
+			if pos+2 > len(zl) {
+				return nil, errBadEncoding
+			}
+			header, n = 2, int(b&0x3F)<<8|int(zl[pos+1])
+		case 2:
+			if pos+5 > len(zl) {
+				return nil, errBadEncoding
+			}
+			header, n = 5, int(binary.BigEndian.Uint32(zl[pos+1:]))
+		default:
+			size := 0
+			switch b {
+			case 0xC0:
+				size = 2
+			case 0xD0:
+				size = 4
+			case 0xE0:
+				size = 8
+			case 0xF0:
+				size = 3
+			case 0xFE:
+				size = 1
+			default:
+				// 0xF1 to 0xFD hold 0 to 12 in the encoding byte itself
+				if b < 0xF1 || b > 0xFD {
+					return nil, errBadEncoding
+				}
+				entries = append(entries, strconv.Itoa(int(b&0x0F)-1))
+				pos++
+				continue
+			}
+			if pos+1+size > len(zl) {
+				return nil, errBadEncoding
+			}
+			entries = append(entries, strconv.FormatInt(leInt(zl[pos+1:pos+1+size]), 10))
+			pos += 1 + size
+			continue
+		}
+
+		if n < 0 || pos+header+n > len(zl) {
+			return nil, errBadEncoding
+		}
+		entries = append(entries, string(zl[pos+header:pos+header+n]))
+		pos += header + n
+	}
+}
+
+// listpackEntries returns the entries of a listpack, integers as text.
+//
+//	<total bytes: 4> <count: 2> entries 0xFF
+//	entry: <encoding> <data> <backlen: 1 to 5>
+func listpackEntries(lp []byte) ([]string, error) {
+	var entries []string
+	pos := 6
+	for {
+		if pos >= len(lp) {
+			return nil, errBadEncoding
+		}
+		b := lp[pos]
+		if b == 0xFF {
+			return entries, nil
+		}
+
+		// size covers the encoding and the data, not the backlen
+		var entry string
+		var size int
+		need := func(n int) bool { return pos+n <= len(lp) }
+		switch {
+		case b&0x80 == 0:
+			entry, size = strconv.Itoa(int(b)), 1
+		case b&0xC0 == 0x80:
+			n := int(b & 0x3F)
+			if size = 1 + n; !need(size) {
+				return nil, errBadEncoding
+			}
+			entry = string(lp[pos+1 : pos+size])
+		case b&0xE0 == 0xC0:
+			if size = 2; !need(size) {
+				return nil, errBadEncoding
+			}
+			v := int(b&0x1F)<<8 | int(lp[pos+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			entry = strconv.Itoa(v)
+		case b&0xF0 == 0xE0:
+			if !need(2) {
+				return nil, errBadEncoding
+			}
+			n := int(b&0x0F)<<8 | int(lp[pos+1])
+			if size = 2 + n; !need(size) {
+				return nil, errBadEncoding
+			}
+			entry = string(lp[pos+2 : pos+size])
+		case b == 0xF0:
+			if !need(5) {
+				return nil, errBadEncoding
+			}
+			n := int(binary.LittleEndian.Uint32(lp[pos+1:]))
+			if size = 5 + n; n < 0 || !need(size) {
+				return nil, errBadEncoding
+			}
+			entry = string(lp[pos+5 : pos+size])
+		case b >= 0xF1 && b <= 0xF4:
+			size = 1 + [...]int{2, 3, 4, 8}[b-0xF1]
+			if !need(size) {
+				return nil, errBadEncoding
+			}
+			entry = strconv.FormatInt(leInt(lp[pos+1:pos+size]), 10)
+		default:
+			return nil, errBadEncoding
+		}
+		entries = append(entries, entry)
+		pos += size + listpackBacklenSize(size)
+	}
+}
+
+// listpackBacklenSize returns how many bytes encode the length of an entry
+// at its end.
+func listpackBacklenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// intsetEntries returns the integers of an intset as text.
+//
+//	<encoding: 4, bytes per integer> <count: 4> integers
+func intsetEntries(is []byte) ([]string, error) {
+	if len(is) < 8 {
+		return nil, errBadEncoding
+	}
+	size := int(binary.LittleEndian.Uint32(is))
+	n := int(binary.LittleEndian.Uint32(is[4:]))
+	if (size != 2 && size != 4 && size != 8) || n < 0 || len(is) != 8+n*size {
+		return nil, errBadEncoding
+	}
+	entries := make([]string, n)
+	for i := range entries {
+		entries[i] = strconv.FormatInt(leInt(is[8+i*size:8+(i+1)*size]), 10)
+	}
+	return entries, nil
+}
+
+// zipmapEntries returns the fields and values of a zipmap, alternating.
+//
+//	<count: 1> (<len> field <len> <free: 1> value <free bytes>)... 0xFF
+//	len: 1 byte below 254, or 254 followed by 4 bytes
+func zipmapEntries(zm []byte) ([]string, error) {
+	var entries []string
+	pos := 1
+	readLen := func() (int, bool) {
+		if pos >= len(zm) {
+			return 0, false
+		}
+		if b := zm[pos]; b < 254 {
+			pos++
+			return int(b), true
+		}
+		if zm[pos] != 254 || pos+5 > len(zm) {
+			return 0, false
+		}
+		n := int(binary.LittleEndian.Uint32(zm[pos+1:]))
+		pos += 5
+		return n, true
+	}
+
+	for {
+		if pos >= len(zm) {
+			return nil, errBadEncoding
+		}
+		if zm[pos] == 0xFF {
+			return entries, nil
+		}
+
+		n, ok := readLen()
+		if !ok || n < 0 || pos+n > len(zm) {
+			return nil, errBadEncoding
+		}
+		entries = append(entries, string(zm[pos:pos+n]))
+		pos += n
+
+		n, ok = readLen()
+		if !ok || n < 0 || pos+1+n > len(zm) {
+			return nil, errBadEncoding
+		}
+		free := int(zm[pos])
+		entries = append(entries, string(zm[pos+1:pos+1+n]))
+		pos += 1 + n + free
+	}
+}
+
+// lzfDecompress expands LZF compressed data to its original size.
+func lzfDecompress(in []byte, size int) ([]byte, error) {
+	errLZF := errors.New("corrupted LZF compressed string")
+	out := make([]byte, 0, size)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// Literal run of ctrl+1 bytes
+			n := ctrl + 1
+			if i+n > len(in) || len(out)+n > size {
+				return nil, errLZF
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+
+		// Back reference of n+2 bytes, they may overlap what they produce
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errLZF
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errLZF
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 || len(out)+n+2 > size {
+			return nil, errLZF
+		}
+		for j := 0; j < n+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != size {
+		return nil, errLZF
+	}
+	return out, nil
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// contents returns what an object holds: a string, a map[string]string or a
+// []string.
+func contents(obj *Object) any {
+	switch obj.Type {
+	case typeHash:
+		return maps.Collect(obj.Hash.all())
+	case typeList:
+		return obj.elements()
+	}
+	return obj.Content
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "rdb", name+".rdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func repeat(n ...int) []string {
+	var s []string
+	for _, n := range n {
+		s = append(s, strings.Repeat("a", n))
+	}
+	return s
+}
+
+// The files in testdata/rdb were written by Redis 2.4 to 3.2, see the
+// LICENCE file there.
+func TestReadRDBFixtures(t *testing.T) {
+	tests := []struct {
+		file string
+		want map[int]map[string]any // Keys by database
+	}{
+		{"empty_database", nil},
+		{"multiple_databases", map[int]map[string]any{
+			0: {"key_in_zeroth_database": "zero"},
+			2: {"key_in_second_database": "second"},
+		}},
+		// Its deadline passed long ago
+		{"keys_with_expiry", nil},
+		{"keys_with_mixed_expiry", map[int]map[string]any{
+			0: {
+				"key01": "this does expire",
+				"key02": "this does not expire",
+				"key03": "this does not expire",
+				"key04": "this does expire",
+			},
+		}},
+		{"integer_keys", map[int]map[string]any{
+			0: {
+				"125":        "Positive 8 bit integer",
+				"43947":      "Positive 16 bit integer",
+				"183358245":  "Positive 32 bit integer",
+				"-123":       "Negative 8 bit integer",
+				"-29477":     "Negative 16 bit integer",
+				"-183358245": "Negative 32 bit integer",
+			},
+		}},
+		{"easily_compressible_string_key", map[int]map[string]any{
+			0: {strings.Repeat("a", 200): "Key that redis should compress easily"},
+		}},
+		{"zipmap_that_compresses_easily", map[int]map[string]any{
+			0: {"zipmap_compresses_easily": map[string]string{
+				"a": "aa", "aa": "aaaa", "aaaaa": "aaaaaaaaaaaaaa",
+			}},
+		}},
+		{"zipmap_that_doesnt_compress", map[int]map[string]any{
+			0: {"zimap_doesnt_compress": map[string]string{"MKD1G6": "2", "YNNXK": "F7TI"}},
+		}},
+		{"hash_as_ziplist", map[int]map[string]any{
+			0: {"zipmap_compresses_easily": map[string]string{
+				"a": "aa", "aa": "aaaa", "aaaaa": "aaaaaaaaaaaaaa",
+			}},
+		}},
+		{"ziplist_that_compresses_easily", map[int]map[string]any{
+			0: {"ziplist_compresses_easily": repeat(6, 12, 18, 24, 30, 36)},
+		}},
+		{"ziplist_that_doesnt_compress", map[int]map[string]any{
+			0: {"ziplist_doesnt_compress": []string{
+				"aj2410", "cc953a17a8e096e76a44169ad3f9ac87c5f8248a403274416179aa9fbd852344",
+			}},
+		}},
+		{"ziplist_with_integers", map[int]map[string]any{
+			0: {"ziplist_with_integers": []string{
+				"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12",
+				"-2", "13", "25", "-61", "63", "16380", "-16000", "65535", "-65523",
+				"4194304", "9223372036854775807",
+			}},
+		}},
+		// Bluedis has no sets or sorted sets, they are read and left out
+		{"intset_16", nil},
+		{"intset_32", nil},
+		{"intset_64", nil},
+		{"regular_set", nil},
+		{"sorted_set_as_ziplist", nil},
+		{"rdb_version_5_with_checksum", map[int]map[string]any{
+			0: {
+				"abcd":         "efgh",
+				"foo":          "bar",
+				"bar":          "baz",
+				"abcdef":       "abcdef",
+				"longerstring": "thisisalongerstring.idontknowwhatitmeans",
+				"abc":          "def",
+			},
+		}},
+		{"rdb_v7_list_quicklist", map[int]map[string]any{
+			0: {"foo": []string{"bar", "baz", "boo"}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			ds, err := ReadRDB(bytes.NewReader(readFixture(t, tt.file)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[int]map[string]any)
+			for _, i := range ds.indexes() {
+				got[i] = make(map[string]any)
+				for key, obj := range ds.dbs[i] {
+					got[i][key] = contents(obj)
+				}
+			}
+			want := tt.want
+			if want == nil {
+				want = make(map[int]map[string]any)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestReadRDBDeadlines(t *testing.T) {
+	ds, err := ReadRDB(bytes.NewReader(readFixture(t, "keys_with_mixed_expiry")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"key01": 2080245030932, "key04": 2080245034115}
+	for key, obj := range ds.dbs[0] {
+		deadline, ok := want[key]
+		if obj.HasExpiry != ok || ok && obj.Begone.UnixMilli() != deadline {
+			t.Errorf("%s expires at %v (%v), want %d (%v)", key, obj.Begone.UnixMilli(), obj.HasExpiry, deadline, ok)
+		}
+	}
+}
+
+// The values of this file are random, only their size is known.
+func TestReadRDBBigZipmap(t *testing.T) {
+	ds, err := ReadRDB(bytes.NewReader(readFixture(t, "zipmap_with_big_values")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := ds.dbs[0]["zipmap_with_big_values"]
+	if obj == nil || obj.Type != typeHash {
+		t.Fatalf("got %v, want a hash", obj)
+	}
+	want := map[string]int{"253bytes": 253, "254bytes": 254, "255bytes": 255, "300bytes": 300, "20kbytes": 20000}
+	got := make(map[string]int)
+	for field, value := range obj.Hash.all() {
+		got[field] = len(value)
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("got sizes %v, want %v", got, want)
+	}
+}
+
+// lpEntry encodes a listpack entry, a string or an int64, followed by its
+// backlen.
+func lpEntry(v any) []byte {
+	var b []byte
+	switch v := v.(type) {
+	case string:
+		switch n := len(v); {
+		case n < 64:
+			b = append([]byte{0x80 | byte(n)}, v...)
+		case n < 4096:
+			b = append([]byte{0xE0 | byte(n>>8), byte(n)}, v...)
+		default:
+			b = append(binary.LittleEndian.AppendUint32([]byte{0xF0}, uint32(n)), v...)
+		}
+	case int64:
+		switch {
+		case v >= 0 && v <= 127:
+			b = []byte{byte(v)}
+		case v >= -4096 && v <= 4095:
+			b = []byte{0xC0 | byte(uint64(v)>>8)&0x1F, byte(v)}
+		case v >= math.MinInt16 && v <= math.MaxInt16:
+			b = binary.LittleEndian.AppendUint16([]byte{0xF1}, uint16(v))
+		case v >= -1<<23 && v < 1<<23:
+			b = binary.LittleEndian.AppendUint32([]byte{0xF2}, uint32(v))[:4]
+		case v >= math.MinInt32 && v <= math.MaxInt32:
+			b = binary.LittleEndian.AppendUint32([]byte{0xF3}, uint32(v))
+		default:
+			b = binary.LittleEndian.AppendUint64([]byte{0xF4}, uint64(v))
+		}
+	}
+
+	// The backlen is the size of the entry in groups of 7 bits, the last
+	// group first and every group but the first flagged with 0x80
+	var backlen []byte
+	for n := len(b); ; n >>= 7 {
+		group := byte(n & 0x7F)
+		if len(backlen) > 0 {
+			group |= 0x80
+		}
+		backlen = append([]byte{group}, backlen...)
+		if n < 0x80 {
+			break
+		}
+	}
+	return append(b, backlen...)
+}
+
+// listpack encodes the given strings and int64s as a listpack.
+func listpack(entries ...any) []byte {
+	var body []byte
+	for _, e := range entries {
+		body = append(body, lpEntry(e)...)
+	}
+	lp := binary.LittleEndian.AppendUint32(nil, uint32(6+len(body)+1))
+	lp = binary.LittleEndian.AppendUint16(lp, uint16(len(entries)))
+	return append(append(lp, body...), 0xFF)
+}
+
+func TestListpackEntries(t *testing.T) {
+	entries := []any{
+		"", "abc", strings.Repeat("x", 100), strings.Repeat("y", 5000),
+		int64(0), int64(127), int64(128), int64(-1), int64(4095), int64(-4096),
+		int64(30000), int64(-30000), int64(1<<23 - 1), int64(-1 << 23),
+		int64(math.MaxInt32), int64(math.MinInt32), int64(math.MaxInt64), int64(math.MinInt64),
+	}
+	want := make([]string, len(entries))
+	for i, e := range entries {
+		want[i] = fmt.Sprint(e)
+	}
+	got, err := listpackEntries(listpack(entries...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestIntsetEntries(t *testing.T) {
+	tests := []struct {
+		intset []byte
+		want   []string
+	}{
+		// As stored in intset_16.rdb
+		{[]byte{2, 0, 0, 0, 3, 0, 0, 0, 0xFC, 0x7F, 0xFD, 0x7F, 0xFE, 0x7F}, []string{"32764", "32765", "32766"}},
+		{[]byte{4, 0, 0, 0, 2, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 1, 0}, []string{"-1", "65536"}},
+		{[]byte{8, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x80}, []string{strconv.Itoa(math.MinInt64)}},
+		{[]byte{2, 0, 0, 0, 0, 0, 0, 0}, []string{}},
+	}
+	for _, tt := range tests {
+		got, err := intsetEntries(tt.intset)
+		if err != nil {
+			t.Errorf("intsetEntries(%x): %v", tt.intset, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("intsetEntries(%x) = %q, want %q", tt.intset, got, tt.want)
+		}
+	}
+}
+
+func TestLZFDecompress(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		size int
+		want string
+	}{
+		{[]byte{2, 'a', 'b', 'c'}, 3, "abc"},
+		// A back reference to the first 3 bytes
+		{[]byte{2, 'a', 'b', 'c', 1 << 5, 2}, 6, "abcabc"},
+		// A back reference that overlaps what it produces
+		{[]byte{0, 'a', 3 << 5, 0}, 6, "aaaaaa"},
+		// A long back reference, with its extra length byte
+		{[]byte{0, 'a', 7 << 5, 3, 0}, 13, strings.Repeat("a", 13)},
+	}
+	for _, tt := range tests {
+		got, err := lzfDecompress(tt.in, tt.size)
+		if err != nil {
+			t.Errorf("lzfDecompress(%x): %v", tt.in, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("lzfDecompress(%x) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEntriesCorrupted(t *testing.T) {
+	decoders := map[string]func([]byte) ([]string, error){
+		"ziplist":  ziplistEntries,
+		"listpack": listpackEntries,
+		"intset":   intsetEntries,
+		"zipmap":   zipmapEntries,
+		"lzf": func(b []byte) ([]string, error) {
+			out, err := lzfDecompress(b, 6)
+			return []string{string(out)}, err
+		},
+	}
+	tests := []struct {
+		decoder string
+		blob    []byte
+	}{
+		{"ziplist", nil},
+		{"ziplist", make([]byte, 10)},
+		{"ziplist", append(make([]byte, 10), 0, 0x05, 'a')},              // String past the end
+		{"ziplist", append(make([]byte, 10), 0, 0x40)},                   // Missing second length byte
+		{"ziplist", append(make([]byte, 10), 0, 0x80, 0xFF, 0xFF, 0xFF)}, // Missing length bytes
+		{"ziplist", append(make([]byte, 10), 0, 0xC0, 1)},                // Integer past the end
+		{"ziplist", append(make([]byte, 10), 0, 0xF1)},                   // No end marker
+		{"ziplist", append(make([]byte, 10), 0, 0xFF-1)},                 // Missing 8 bit integer
+		{"ziplist", append(make([]byte, 10), 0, 0xC5, 0xFF)},             // Unknown encoding
+		{"ziplist", append(make([]byte, 10), 0xFE, 0, 0)},                // Long prevlen past the end
+		{"listpack", nil},
+		{"listpack", make([]byte, 6)},
+		{"listpack", append(make([]byte, 6), 0x85, 'a')},
+		{"listpack", append(make([]byte, 6), 0xC0)},
+		{"listpack", append(make([]byte, 6), 0xE1)},
+		{"listpack", append(make([]byte, 6), 0xE0, 10, 'a')},
+		{"listpack", append(make([]byte, 6), 0xF0, 0xFF, 0xFF, 0xFF, 0xFF, 'a')},
+		{"listpack", append(make([]byte, 6), 0xF4, 1, 2)},
+		{"listpack", append(make([]byte, 6), 0xF5, 0xFF)},
+		{"listpack", append(make([]byte, 6), 0x01, 0x01)}, // No end marker
+		{"intset", []byte{2, 0, 0, 0}},
+		{"intset", []byte{3, 0, 0, 0, 0, 0, 0, 0}},
+		{"intset", []byte{2, 0, 0, 0, 2, 0, 0, 0, 1, 0}},
+		{"intset", []byte{8, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 1, 0}},
+		{"zipmap", nil},
+		{"zipmap", []byte{1}},
+		{"zipmap", []byte{1, 5, 'a'}},
+		{"zipmap", []byte{1, 254, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"zipmap", []byte{1, 1, 'a', 5, 0, 'b'}},
+		{"zipmap", []byte{1, 1, 'a', 1, 10, 'b', 0xFF}}, // Free bytes past the end
+		{"zipmap", []byte{1, 1, 'a'}},
+		{"lzf", []byte{5, 'a'}},                    // Literal past the end
+		{"lzf", []byte{1 << 5, 0}},                 // Reference before the start
+		{"lzf", []byte{0, 'a', 1 << 5}},            // Missing offset
+		{"lzf", []byte{0, 'a', 7 << 5}},            // Missing length
+		{"lzf", []byte{2, 'a', 'b', 'c'}},          // Too short
+		{"lzf", []byte{0, 'a', 7 << 5, 10, 0}},     // Too long
+		{"lzf", []byte{7, 1, 2, 3, 4, 5, 6, 7, 8}}, // Literal too long
+	}
+	for _, tt := range tests {
+		if got, err := decoders[tt.decoder](tt.blob); err == nil {
+			t.Errorf("%s %x = %q, want an error", tt.decoder, tt.blob, got)
+		}
+	}
+}
+
+// buildRDB returns an RDB file of the given version holding what fill writes.
+func buildRDB(version int, fill func(rw *rdbWriter)) []byte {
+	var b bytes.Buffer
+	rw := &rdbWriter{w: bufio.NewWriter(&b)}
+	rw.write([]byte(fmt.Sprintf("%s%04d", rdbMagic, version)))
+	rw.writeAux("redis-ver", "7.2.4")
+	fill(rw)
+	rw.writeByte(rdbOpEOF)
+	rw.write(binary.LittleEndian.AppendUint64(nil, rw.crc))
+	rw.w.Flush()
+	return b.Bytes()
+}
+
+// No Redis 7 was at hand to write listpack encoded keys, so they are built
+// here following its rdb.c and listpack.c.
+func TestReadRDBListpacks(t *testing.T) {
+	deadline := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	data := buildRDB(11, func(rw *rdbWriter) {
+		rw.writeByte(rdbOpSelectDB)
+		rw.writeLength(0)
+		rw.writeByte(rdbOpResizeDB)
+		rw.writeLength(4)
+		rw.writeLength(1)
+
+		rw.writeByte(rdbOpExpireTimeMs)
+		rw.write(binary.LittleEndian.AppendUint64(nil, uint64(deadline.UnixMilli())))
+		rw.writeByte(rdbTypeHashListpack)
+		rw.writeString("hash")
+		rw.writeString(string(listpack("name", "bluedis", "port", int64(6379), "big", strings.Repeat("b", 300))))
+
+		rw.writeByte(rdbTypeListQuicklist2)
+		rw.writeString("list")
+		rw.writeLength(2)
+		rw.writeLength(quicklistNodePacked)
+		rw.writeString(string(listpack("a", int64(-5), int64(100000))))
+		rw.writeLength(quicklistNodePlain)
+		rw.writeString(strings.Repeat("p", 1000))
+
+		rw.writeByte(rdbTypeSetListpack)
+		rw.writeString("set")
+		rw.writeString(string(listpack("x", "y")))
+
+		rw.writeByte(rdbTypeZsetListpack)
+		rw.writeString("zset")
+		rw.writeString(string(listpack("x", int64(1), "y", "2.5")))
+	})
+
+	ds, err := ReadRDB(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := ds.dbs[0]
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want the hash and the list only", len(keys))
+	}
+	hash := keys["hash"]
+	wantHash := map[string]string{"name": "bluedis", "port": "6379", "big": strings.Repeat("b", 300)}
+	if hash == nil || !reflect.DeepEqual(contents(hash), wantHash) {
+		t.Errorf("hash = %v, want %v", hash, wantHash)
+	} else if !hash.HasExpiry || !hash.Begone.Equal(deadline) {
+		t.Errorf("hash expires at %v, want %v", hash.Begone, deadline)
+	}
+	list := keys["list"]
+	wantList := []string{"a", "-5", "100000", strings.Repeat("p", 1000)}
+	if list == nil || !reflect.DeepEqual(contents(list), wantList) {
+		t.Errorf("list = %v, want %v", list, wantList)
+	} else if list.HasExpiry {
+		t.Errorf("list expires at %v, want no deadline", list.Begone)
+	}
+}
+
+func TestRDBRoundTrip(t *testing.T) {
+	now := time.Now()
+	ds := newDataset()
+
+	ds.db(0)["string"] = newString("value")
+	ds.db(0)["empty"] = newString("")
+	ds.db(0)["long"] = newString(strings.Repeat("0123456789", 10000))
+	hash := newHash()
+	hash.Hash.set("f1", "v1")
+	hash.Hash.set("f2", "")
+	hash.FieldExpires = map[string]time.Time{"f1": now.Add(time.Hour)}
+	ds.db(0)["hash"] = hash
+	list := newList()
+	for _, element := range []string{"c", "b", "a", "42"} {
+		list.List.PushRight(element)
+	}
+	ds.db(0)["list"] = list
+
+	volatile := newString("soon gone")
+	volatile.HasExpiry = true
+	volatile.Begone = now.Add(time.Minute)
+	ds.db(3)["volatile"] = volatile
+	dead := newString("gone")
+	dead.HasExpiry = true
+	dead.Begone = now.Add(-time.Minute)
+	ds.db(3)["dead"] = dead
+	ds.db(15)["last"] = newString("db 15")
+
+	var b bytes.Buffer
+	if err := ds.WriteRDB(&b); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadRDB(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int{0, 3, 15}; !slices.Equal(got.indexes(), want) {
+		t.Fatalf("got databases %v, want %v", got.indexes(), want)
+	}
+	if _, ok := got.dbs[3]["dead"]; ok {
+		t.Error("a key past its deadline was loaded")
+	}
+	for i, keys := range ds.dbs {
+		for key, obj := range keys {
+			if key == "dead" {
+				continue
+			}
+			loaded, ok := got.dbs[i][key]
+			if !ok {
+				t.Errorf("db %d: key %q is missing", i, key)
+				continue
+			}
+			if !reflect.DeepEqual(contents(loaded), contents(obj)) {
+				t.Errorf("db %d: key %q = %.40v, want %.40v", i, key, contents(loaded), contents(obj))
+			}
+			if loaded.HasExpiry != obj.HasExpiry || loaded.Begone.UnixMilli() != obj.Begone.UnixMilli() {
+				t.Errorf("db %d: key %q expires at %v, want %v", i, key, loaded.Begone, obj.Begone)
+			}
+			if loaded.FieldExpires != nil {
+				t.Errorf("db %d: key %q has field deadlines, RDB version 9 can't hold them", i, key)
+			}
+		}
+	}
+}
+
+var corruptionFixtures = []string{
+	"multiple_databases",
+	"keys_with_mixed_expiry",
+	"integer_keys",
+	"easily_compressible_string_key",
+	"zipmap_that_compresses_easily",
+	"zipmap_with_big_values",
+	"hash_as_ziplist",
+	"ziplist_with_integers",
+	"intset_64",
+	"regular_set",
+	"sorted_set_as_ziplist",
+	"rdb_version_5_with_checksum",
+	"rdb_v7_list_quicklist",
+}
+
+func TestReadRDBTruncated(t *testing.T) {
+	for _, name := range corruptionFixtures {
+		data := readFixture(t, name)
+		step := max(1, len(data)/500)
+		for n := 0; n < len(data); n += step {
+			if _, err := ReadRDB(bytes.NewReader(data[:n])); err == nil {
+				t.Errorf("%s cut after %d of %d bytes: no error", name, n, len(data))
+			}
+		}
+	}
+	// A listpack file, whose keys are read by other means
+	data := buildRDB(11, func(rw *rdbWriter) {
+		rw.writeByte(rdbTypeListQuicklist2)
+		rw.writeString("list")
+		rw.writeLength(1)
+		rw.writeLength(quicklistNodePacked)
+		rw.writeString(string(listpack("a", "b", int64(1))))
+	})
+	for n := range len(data) {
+		if _, err := ReadRDB(bytes.NewReader(data[:n])); err == nil {
+			t.Errorf("listpack file cut after %d of %d bytes: no error", n, len(data))
+		}
+	}
+}
+
+// Damaged files must be reported, or at worst loaded with wrong values when
+// there is no checksum to catch it, but never crash the server.
+func TestReadRDBCorrupted(t *testing.T) {
+	for _, name := range corruptionFixtures {
+		data := readFixture(t, name)
+		version, _ := strconv.Atoi(string(data[len(rdbMagic) : len(rdbMagic)+4]))
+		step := max(1, len(data)/500)
+		for i := 0; i < len(data); i += step {
+			for _, flip := range []byte{0x01, 0x40, 0x80, 0xFF} {
+				damaged := bytes.Clone(data)
+				damaged[i] ^= flip
+				_, err := ReadRDB(bytes.NewReader(damaged))
+				// A damaged version number may turn the checksum off
+				if err == nil && version >= rdbFirstWithCRC && i >= len(rdbMagic)+4 {
+					t.Errorf("%s with byte %d ^ 0x%02X: no error", name, i, flip)
+				}
+			}
+		}
+	}
+}
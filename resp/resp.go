@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -13,50 +15,109 @@ const (
 	INTEGER = ':'
 	BULK    = '$'
 	ARRAY   = '*'
+
+	// Types added by RESP3. They are only sent to clients that switched to
+	// protocol 3 with HELLO, everyone else gets the RESP2 equivalent.
+	NULL      = '_'
+	BOOLEAN   = '#'
+	DOUBLE    = ','
+	BIGNUMBER = '('
+	VERBATIM  = '='
+	MAP       = '%'
+	SET       = '~'
+	PUSH      = '>'
 )
 
 // This struct will support in serialization and deserialization process for
 // RESP (Redis Serialization Protocol)
+//
+// Aggregate types ("array", "map", "set", "push") keep their elements in Array.
+// A map stores its entries flattened as key, value, key, value... so that it
+// becomes a plain array when sent to a RESP2 client. "double" uses Double,
+// "boolean" uses Boolean, "bignum" keeps its digits in Str and "verbatim"
+// keeps its text in Bulk with the three letter format (e.g. "txt") in Format.
 type Value struct {
-	Typ   string
-	Str   string
-	Num   int
-	Bulk  string
-	Array []Value
+	Typ     string
+	Str     string
+	Num     int
+	Bulk    string
+	Array   []Value
+	Double  float64
+	Boolean bool
+	Format  string
 }
 
+// Marshal serializes the value as RESP2. This is also the format the AOF is
+// written in.
 func (v Value) Marshal() []byte {
+	return v.marshal(2)
+}
+
+// MarshalRESP3 serializes the value using the RESP3 types.
+func (v Value) MarshalRESP3() []byte {
+	return v.marshal(3)
+}
+
+func (v Value) marshal(proto int) []byte {
 
 	// For writing data back, we need to Marshal the data into RESP. We are doing
-	// this based on the type and calling specific methods for each
+	// this based on the type and calling specific methods for each. The RESP3
+	// only types fall back to the closest RESP2 type when proto is 2.
 
 	switch v.Typ {
 	case "array":
-		return v.marshalArray()
+		return v.marshalAggregate(ARRAY, proto)
+	case "map":
+		if proto < 3 {
+			return v.marshalAggregate(ARRAY, proto)
+		}
+		return v.marshalAggregate(MAP, proto)
+	case "set":
+		if proto < 3 {
+			return v.marshalAggregate(ARRAY, proto)
+		}
+		return v.marshalAggregate(SET, proto)
+	case "push":
+		if proto < 3 {
+			return v.marshalAggregate(ARRAY, proto)
+		}
+		return v.marshalAggregate(PUSH, proto)
 	case "bulk":
 		return v.marshalBulk()
 	case "string":
 		return v.marshalString()
 	case "null":
-		return v.marshalNull()
+		return v.marshalNull(proto)
 	case "error":
 		return v.marshalError()
 	case "integer":
 		return v.marshalInteger()
+	case "double":
+		return v.marshalDouble(proto)
+	case "boolean":
+		return v.marshalBoolean(proto)
+	case "bignum":
+		return v.marshalBigNumber(proto)
+	case "verbatim":
+		return v.marshalVerbatim(proto)
 	default:
 		return []byte{}
 	}
 }
 
-func (v Value) marshalArray() []byte {
+func (v Value) marshalAggregate(prefix byte, proto int) []byte {
 	var bytes []byte
 	length := len(v.Array)
-	bytes = append(bytes, ARRAY)
+	if prefix == MAP {
+		// A map announces the number of entries, not the number of elements
+		length /= 2
+	}
+	bytes = append(bytes, prefix)
 	bytes = append(bytes, strconv.Itoa(length)...)
 	bytes = append(bytes, '\r', '\n')
 
-	for i := 0; i < length; i++ {
-		bytes = append(bytes, v.Array[i].Marshal()...)
+	for i := 0; i < len(v.Array); i++ {
+		bytes = append(bytes, v.Array[i].marshal(proto)...)
 	}
 
 	return bytes
@@ -82,7 +143,10 @@ func (v Value) marshalString() []byte {
 	return bytes
 }
 
-func (v Value) marshalNull() []byte {
+func (v Value) marshalNull(proto int) []byte {
+	if proto >= 3 {
+		return []byte("_\r\n")
+	}
 	return []byte("$-1\r\n") // This is the null representation according to RESP
 }
 
@@ -100,18 +164,175 @@ func (v Value) marshalInteger() []byte {
 	return []byte(fmt.Sprintf(":%d\r\n", v.Num)) // The format is ":<integer>\r\n" as specified by the Redis Serialization Protocol.
 }
 
+// marshalDouble sends ",<float>\r\n" in RESP3 and the same digits as a bulk
+// string in RESP2, which is how Redis has always returned floats.
+func (v Value) marshalDouble(proto int) []byte {
+	text := FormatDouble(v.Double)
+	if proto < 3 {
+		return Value{Typ: "bulk", Bulk: text}.marshalBulk()
+	}
+	return []byte(string(DOUBLE) + text + "\r\n")
+}
+
+// marshalBoolean sends "#t\r\n" or "#f\r\n" in RESP3 and 1 or 0 in RESP2.
+func (v Value) marshalBoolean(proto int) []byte {
+	if proto < 3 {
+		if v.Boolean {
+			return Value{Typ: "integer", Num: 1}.marshalInteger()
+		}
+		return Value{Typ: "integer", Num: 0}.marshalInteger()
+	}
+	if v.Boolean {
+		return []byte("#t\r\n")
+	}
+	return []byte("#f\r\n")
+}
+
+func (v Value) marshalBigNumber(proto int) []byte {
+	if proto < 3 {
+		return Value{Typ: "bulk", Bulk: v.Str}.marshalBulk()
+	}
+	return []byte(string(BIGNUMBER) + v.Str + "\r\n")
+}
+
+// marshalVerbatim prefixes the text with its format ("txt:" or "mkd:") in
+// RESP3. RESP2 clients just get the text as a bulk string.
+func (v Value) marshalVerbatim(proto int) []byte {
+	if proto < 3 {
+		return v.marshalBulk()
+	}
+	format := v.Format
+	if format == "" {
+		format = "txt"
+	}
+	var bytes []byte
+	bytes = append(bytes, VERBATIM)
+	bytes = append(bytes, strconv.Itoa(len(format)+1+len(v.Bulk))...)
+	bytes = append(bytes, '\r', '\n')
+	bytes = append(bytes, format...)
+	bytes = append(bytes, ':')
+	bytes = append(bytes, v.Bulk...)
+	bytes = append(bytes, '\r', '\n')
+
+	return bytes
+}
+
+// FormatDouble renders a float the way Redis does in replies: the shortest
+// representation that round-trips, with "inf", "-inf" and "nan" spelled out.
+func FormatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// ProtocolError is returned by Read when the client sent something that is not
+// valid RESP. The connection cannot be trusted to be in sync after it.
+type ProtocolError string
+
+func (e ProtocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
 type Resp struct {
-	reader *bufio.Reader
+	reader  *bufio.Reader
+	counter *countingReader
 }
 
 func NewResp(rd io.Reader) *Resp {
 	// The buffer created during the connection to PORT 6379 would be passed to
 	// this function for generating responses
+	counter := &countingReader{reader: rd}
 	return &Resp{
-		reader: bufio.NewReader(rd),
+		reader:  bufio.NewReader(counter),
+		counter: counter,
 	}
 }
 
+// countingReader counts the bytes read from the underlying reader, which is
+// how Resp knows its offset despite bufio reading ahead. Bytes Drain read
+// behind its back are pending, and returned before anything else.
+type countingReader struct {
+	reader  io.Reader
+	n       int64
+	pending []byte
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	if len(c.pending) > 0 {
+		n = copy(p, c.pending)
+		c.pending = c.pending[n:]
+	} else {
+		n, err = c.reader.Read(p)
+	}
+	c.n += int64(n)
+	return n, err
+}
+
+// Offset returns the number of bytes consumed so far, that is the position
+// right after the last value returned by Read.
+func (r *Resp) Offset() int64 {
+	return r.counter.n - int64(r.reader.Buffered())
+}
+
+// ReadCommand reads a request that has to be a RESP array, which is the only
+// form commands are stored in inside the AOF. Unlike Read it does not accept
+// inline commands, so garbage is reported instead of being taken for one.
+func (r *Resp) ReadCommand() (Value, error) {
+	b, err := r.reader.Peek(1)
+	if err != nil {
+		return Value{}, err
+	}
+	if b[0] != ARRAY {
+		return Value{}, ProtocolError(fmt.Sprintf("expected '*', got '%c'", b[0]))
+	}
+	r.reader.ReadByte()
+	return r.readArray()
+}
+
+// ReadAnnotation reads an annotation line, such as the "#TS:<unix time>" the
+// AOF holds between commands, without the leading '#'. It returns false when
+// what comes next is not an annotation.
+func (r *Resp) ReadAnnotation() (string, bool, error) {
+	b, err := r.reader.Peek(1)
+	if err != nil || b[0] != '#' {
+		return "", false, err
+	}
+	line, _, err := r.readLine()
+	if err != nil {
+		return "", false, err
+	}
+	return string(line[1:]), true, nil
+}
+
+// Drain keeps reading the underlying reader, past any input already buffered,
+// until it fails, and returns that error, such as io.EOF once the other side
+// closed the connection. What arrives meanwhile is kept and parsed by later
+// reads as if it had never been taken out. It gives up reading, returning nil,
+// once MaxBulkSize bytes are kept.
+func (r *Resp) Drain() error {
+	buf := make([]byte, 4096)
+	for len(r.counter.pending) < MaxBulkSize {
+		n, err := r.counter.reader.Read(buf)
+		r.counter.pending = append(r.counter.pending, buf[:n]...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Buffered returns the number of bytes that have already been received but not
+// parsed yet. A non-zero value means the client has pipelined more commands.
+func (r *Resp) Buffered() int {
+	return r.reader.Buffered()
+}
+
 func (r *Resp) readLine() (line []byte, n int, err error) {
 	// Read line from buffer. We read one byte at a time until we reach '\r',
 	// which indicates the end of the line. Then we return the line without the
@@ -124,6 +345,9 @@ func (r *Resp) readLine() (line []byte, n int, err error) {
 		n += 1
 
 		line = append(line, b)
+		if len(line) > maxInlineSize {
+			return nil, 0, ProtocolError("too big line")
+		}
 
 		// At any point if the second last character of the line buffer is carriage
 		// return then we can break out of the for loop and return the line by
@@ -136,7 +360,10 @@ func (r *Resp) readLine() (line []byte, n int, err error) {
 	return line[:len(line)-2], n, nil
 }
 
-func (r *Resp) readInteger() (x int, n int, err error) {
+// readInteger reads a line holding a number. A line that is not one is reported
+// as a ProtocolError saying invalid, such as "invalid bulk length", so that
+// the client gets an error reply instead of a silently dropped connection.
+func (r *Resp) readInteger(invalid string) (x int, n int, err error) {
 	line, n, err := r.readLine()
 	if err != nil {
 		return 0, 0, err
@@ -148,38 +375,26 @@ func (r *Resp) readInteger() (x int, n int, err error) {
 
 	i64, err := strconv.ParseInt(string(line), 10, 64)
 	if err != nil {
-		return 0, n, err
+		return 0, n, ProtocolError(invalid)
 	}
 	return int(i64), n, nil
 }
 
 func (r *Resp) Read() (Value, error) {
-	// Method to read from the buffer recursively. This is needed to read the
-	// Value again and again for each step of the input we received so that we
-	// can parse it according to the character at the beginning of the line.
-
-	_type, err := r.reader.ReadByte()
+	// A request is either a RESP array or an inline command, the plain text
+	// format used by telnet/nc sessions (e.g. "PING\r\n"). Like Redis, any
+	// other first byte starts an inline command, so "+PING" is a command
+	// named "+PING" rather than a simple string nobody would answer. Both
+	// forms can be mixed freely on the same connection.
+	b, err := r.reader.Peek(1)
 	if err != nil {
 		return Value{}, err
 	}
-
-	// Read the first byte to determine the RESP type which is to be parsed as per
-	// the switch statement.
-	switch _type {
-	case ARRAY:
+	if b[0] == ARRAY {
+		r.reader.ReadByte()
 		return r.readArray()
-	case BULK:
-		return r.readBulk()
-	case STRING:
-		return r.readString()
-	case INTEGER:
-		return r.readIntegerVal()
-	case ERROR:
-		return r.readError()
-	default:
-		fmt.Printf("Unknown type: %v", string(_type))
-		return Value{}, nil
 	}
+	return r.readInline()
 }
 
 func (r *Resp) readArray() (v Value, err error) {
@@ -187,28 +402,42 @@ func (r *Resp) readArray() (v Value, err error) {
 	// Steps for reading the Array:
 	// 1. Skip the first byte because we have already read it in the Read method
 	// 2. Read the integer that represents the number of elements in the array
-	// 3. Iterate over the array and for each line, call the Read method to parse
-	// the type according too the character at the beginning of the line
+	// 3. Iterate over the array and read each element, which has to be a bulk
+	// string as every argument of a request is one. Anything else, a nested
+	// array included, is refused instead of being parsed recursively
 	// 4. With each iteration, append the parsed value to the array in the Value
 	// object and return it
 
 	v.Typ = "array"
 
-	length, _, err := r.readInteger()
+	length, _, err := r.readInteger("invalid multibulk length")
 	if err != nil {
 		return v, err
 	}
 
-	// for each line, parse and read the Value
-	v.Array = make([]Value, length)
+	if length < 0 {
+		return v, ProtocolError("invalid multibulk length")
+	}
+
+	// for each line, parse and read the Value. The length comes from the
+	// client, so the array grows as elements actually arrive instead of being
+	// allocated upfront.
+	v.Array = make([]Value, 0, min(length, 1024))
 	for i := 0; i < length; i++ {
-		val, err := r.Read()
+		_type, err := r.reader.ReadByte()
+		if err != nil {
+			return v, err
+		}
+		if _type != BULK {
+			return v, ProtocolError(fmt.Sprintf("expected '$', got '%c'", _type))
+		}
+		val, err := r.readBulk()
 		if err != nil {
 			return v, err
 		}
 
 		// add parsed value to array
-		v.Array[i] = val
+		v.Array = append(v.Array, val)
 	}
 
 	return v, nil
@@ -223,7 +452,7 @@ func (r *Resp) readBulk() (v Value, err error) {
 	// 4. Return the Value object
 
 	v.Typ = "bulk"
-	length, _, err := r.readInteger()
+	length, _, err := r.readInteger("invalid bulk length")
 	if err != nil {
 		return v, err
 	}
@@ -232,6 +461,9 @@ func (r *Resp) readBulk() (v Value, err error) {
 		v.Typ = "null"
 		return v, nil
 	}
+	if length < 0 || length > MaxBulkSize {
+		return v, ProtocolError("invalid bulk length")
+	}
 
 	bulk := make([]byte, length)
 	_, err = io.ReadFull(r.reader, bulk)
@@ -243,55 +475,196 @@ func (r *Resp) readBulk() (v Value, err error) {
 	// Read the trailing CRLF so that the pointer is effectively moved to the
 	// next bulk string correctly. Otherwise, the pointer would be stuck at '\r'
 	// and Read method would not work properly
-	r.readLine()
+	crlf := make([]byte, 2)
+	if _, err := io.ReadFull(r.reader, crlf); err != nil {
+		return v, err
+	}
+	if crlf[0] != '\r' || crlf[1] != '\n' {
+		return v, ProtocolError("expected CRLF after bulk string")
+	}
 
 	return v, nil
 }
 
-func (r *Resp) readString() (v Value, err error) {
-	v.Typ = "string"
-	line, _, err := r.readLine()
-	if err != nil {
-		return v, err
+// MaxBulkSize is the longest bulk string accepted (proto-max-bulk-len in
+// Redis).
+const MaxBulkSize = 512 * 1024 * 1024
+
+// Inline requests longer than this are rejected, like Redis does, so that a
+// client sending garbage without a newline cannot grow the buffer forever.
+const maxInlineSize = 64 * 1024
+
+// readInline reads one line of space separated arguments and returns it as an
+// array of bulk strings, the same shape as a regular RESP request. Empty lines
+// are skipped.
+func (r *Resp) readInline() (v Value, err error) {
+	for {
+		var line []byte
+		for {
+			chunk, err := r.reader.ReadSlice('\n')
+			line = append(line, chunk...)
+			if len(line) > maxInlineSize {
+				return v, ProtocolError("too big inline request")
+			}
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err != nil {
+				return v, err
+			}
+			break
+		}
+
+		args, err := SplitInlineArgs(strings.TrimRight(string(line), "\r\n"))
+		if err != nil {
+			return v, err
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		v.Typ = "array"
+		v.Array = make([]Value, len(args))
+		for i, arg := range args {
+			v.Array[i] = Value{Typ: "bulk", Bulk: arg}
+		}
+		return v, nil
 	}
-	v.Str = string(line)
-	return v, nil
 }
 
-func (r *Resp) readIntegerVal() (v Value, err error) {
-	v.Typ = "integer"
-	num, _, err := r.readInteger()
-	if err != nil {
-		return v, err
+// SplitInlineArgs splits an inline request into its arguments. Arguments are
+// separated by whitespace and may be wrapped in double quotes, which support
+// the usual escapes (\n, \r, \t, \b, \a, \xHH, \\ and \"), or in single
+// quotes where only \' is an escape. This follows sdssplitargs in Redis.
+func SplitInlineArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isInlineSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg []byte
+		inDouble, inSingle := false, false
+		for done := false; !done; {
+			if i == len(line) {
+				if inDouble || inSingle {
+					return nil, ProtocolError("unbalanced quotes in request")
+				}
+				break
+			}
+
+			c := line[i]
+			switch {
+			case inDouble:
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					n, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					arg = append(arg, byte(n))
+					i += 3
+				} else if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						arg = append(arg, '\n')
+					case 'r':
+						arg = append(arg, '\r')
+					case 't':
+						arg = append(arg, '\t')
+					case 'b':
+						arg = append(arg, '\b')
+					case 'a':
+						arg = append(arg, '\a')
+					default:
+						arg = append(arg, line[i])
+					}
+				} else if c == '"' {
+					// The closing quote must be followed by a space or
+					// nothing at all
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, ProtocolError("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			case inSingle:
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					arg = append(arg, '\'')
+				} else if c == '\'' {
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, ProtocolError("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			default:
+				switch c {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDouble = true
+				case '\'':
+					inSingle = true
+				default:
+					arg = append(arg, c)
+				}
+			}
+			i++
+		}
+		args = append(args, string(arg))
 	}
-	v.Num = num
-	return v, nil
 }
 
-func (r *Resp) readError() (v Value, err error) {
-	v.Typ = "error"
-	line, _, err := r.readLine()
-	if err != nil {
-		return v, err
-	}
-	v.Str = string(line)
-	return v, nil
+func isInlineSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == 0
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
 }
 
+// Writer buffers replies instead of writing each of them straight to the
+// connection. When a client pipelines commands, all the replies for one batch
+// end up in a single write once Flush is called. Replies are encoded with the
+// protocol version negotiated by the client, RESP2 unless changed by HELLO.
 type Writer struct {
-	writer io.Writer
+	writer *bufio.Writer
+	proto  int
 }
 
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{
-		writer: w,
+		writer: bufio.NewWriterSize(w, 16*1024),
+		proto:  2,
 	}
 }
 
+// SetProtocol switches the encoding used for the following replies to RESP2
+// or RESP3.
+func (w *Writer) SetProtocol(proto int) {
+	w.proto = proto
+}
+
+// Protocol returns the protocol version replies are currently encoded with.
+func (w *Writer) Protocol() int {
+	return w.proto
+}
+
 func (w *Writer) Write(value Value) error {
 	// Get all the required bytes after marshalling and write everything to the
-	// io.Writer provided in the function. Could be a file or a stdout
-	respData := value.Marshal()
+	// io.Writer provided in the function. Could be a file or a stdout. Nothing
+	// reaches it before Flush unless the buffer fills up.
+	respData := value.marshal(w.proto)
 	_, err := w.writer.Write(respData)
 	return err
 }
+
+// Flush sends every buffered reply to the underlying io.Writer.
+func (w *Writer) Flush() error {
+	return w.writer.Flush()
+}
@@ -0,0 +1,154 @@
+package resp
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitInlineArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"set a b", []string{"set", "a", "b"}},
+		{"  set \t a  ", []string{"set", "a"}},
+		{`set "hello world"`, []string{"set", "hello world"}},
+		{`set ""`, []string{"set", ""}},
+		{`set "\x41\x62"`, []string{"set", "Ab"}},
+		{`set "\x4"`, []string{"set", "x4"}},
+		{`set "\xZZ"`, []string{"set", "xZZ"}},
+		{`set "say \"hi\""`, []string{"set", `say "hi"`}},
+		{`set "a\nb\r\tc\\"`, []string{"set", "a\nb\r\tc\\"}},
+		{`set 'it\'s'`, []string{"set", "it's"}},
+		{`set 'a\nb "c"'`, []string{"set", `a\nb "c"`}},
+		{`set a\`, []string{"set", `a\`}},
+		{`set a"b c"`, []string{"set", "ab c"}},
+	}
+	for _, tt := range tests {
+		got, err := SplitInlineArgs(tt.line)
+		if err != nil {
+			t.Errorf("SplitInlineArgs(%q): %v", tt.line, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("SplitInlineArgs(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestSplitInlineArgsUnbalanced(t *testing.T) {
+	for _, line := range []string{
+		`set "abc`,
+		`set 'abc`,
+		`set "abc"def`,
+		`set 'abc'def`,
+		`set "abc\"`,
+		`set "abc\`,
+		`set 'abc\'`,
+		`set a"b`,
+	} {
+		if args, err := SplitInlineArgs(line); err == nil {
+			t.Errorf("SplitInlineArgs(%q) = %q, want an error", line, args)
+		}
+	}
+}
+
+// bulks returns the strings of a request read by Resp.Read.
+func bulks(t *testing.T, v Value) []string {
+	t.Helper()
+	if v.Typ != "array" {
+		t.Fatalf("got a %s, want an array", v.Typ)
+	}
+	var args []string
+	for _, arg := range v.Array {
+		args = append(args, arg.Bulk)
+	}
+	return args
+}
+
+func TestReadInline(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"PING\r\n", []string{"PING"}},
+		{"PING\n", []string{"PING"}},
+		{"\r\n\r\nECHO hi\r\n", []string{"ECHO", "hi"}},
+		{"*2\r\n$4\r\nECHO\r\n$2\r\nhi\r\n", []string{"ECHO", "hi"}},
+		// Only '*' starts a RESP request, every other byte an inline one
+		{"+PING\r\n", []string{"+PING"}},
+		{"-ERR oops\r\n", []string{"-ERR", "oops"}},
+		{":1\r\n", []string{":1"}},
+		{"$4\r\n", []string{"$4"}},
+	}
+	for _, tt := range tests {
+		v, err := NewResp(strings.NewReader(tt.input)).Read()
+		if err != nil {
+			t.Errorf("Read(%q): %v", tt.input, err)
+			continue
+		}
+		if got := bulks(t, v); !slices.Equal(got, tt.want) {
+			t.Errorf("Read(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestReadMixed(t *testing.T) {
+	r := NewResp(strings.NewReader("SET k \"a b\"\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n+PING\r\n"))
+	for _, want := range [][]string{{"SET", "k", "a b"}, {"GET", "k"}, {"+PING"}} {
+		v, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bulks(t, v); !slices.Equal(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("got %v at the end, want EOF", err)
+	}
+}
+
+func TestReadInlineErrors(t *testing.T) {
+	for _, input := range []string{
+		"SET k \"abc\r\n",
+		"SET k 'abc\r\n",
+		"SET " + strings.Repeat("x", maxInlineSize) + "\r\n",
+	} {
+		_, err := NewResp(strings.NewReader(input)).Read()
+		var protoErr ProtocolError
+		if !errors.As(err, &protoErr) {
+			t.Errorf("Read(%.20q) = %v, want a protocol error", input, err)
+		}
+	}
+}
+
+func TestReadBadLengths(t *testing.T) {
+	tests := []struct {
+		input string
+		want  ProtocolError
+	}{
+		{"*x\r\n", "invalid multibulk length"},
+		{"*-2\r\n", "invalid multibulk length"},
+		{"*1\r\n$x\r\n", "invalid bulk length"},
+		{"*1\r\n$-2\r\n", "invalid bulk length"},
+		{"*1\r\n:1\r\n", "expected '$', got ':'"},
+		{"*2\r\n$3\r\nGET\r\n+k\r\n", "expected '$', got '+'"},
+		// Nested arrays are refused right away, however deep they go
+		{strings.Repeat("*1\r\n", 8_000_000), "expected '$', got '*'"},
+		{"*" + strings.Repeat("1", maxInlineSize+1) + "\r\n", "too big line"},
+		{"*1\r\n$" + strings.Repeat("1", maxInlineSize+1) + "\r\n", "too big line"},
+	}
+	for _, tt := range tests {
+		_, err := NewResp(strings.NewReader(tt.input)).Read()
+		var protoErr ProtocolError
+		if !errors.As(err, &protoErr) || protoErr != tt.want {
+			t.Errorf("Read(%.20q) = %v, want %q", tt.input, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// keys implements KEYS pattern. It goes over the whole database in one go, so
+// SCAN is the way to list keys of a big dataset without holding up the
+// writers.
+func keys(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'keys' command"}
+	}
+	pattern := args[0].Bulk
+
+	keyspaceMu.RLock()
+	defer keyspaceMu.RUnlock()
+
+	now := time.Now()
+	result := []resp.Value{}
+	for key, obj := range db.all() {
+		if obj.expired(now) {
+			continue
+		}
+		if pattern == "*" || globMatch(pattern, key) {
+			result = append(result, resp.Value{Typ: "bulk", Bulk: key})
+		}
+	}
+	return resp.Value{Typ: "array", Array: result}
+}
+
+// Types SCAN accepts for its TYPE option. Bluedis only stores some of them,
+// asking for the others is valid but finds nothing.
+var scanTypes = map[string]bool{
+	typeString: true,
+	typeHash:   true,
+	typeList:   true,
+	"set":      true,
+	"zset":     true,
+	"stream":   true,
+}
+
+// scanOptions are the options shared by the SCAN family.
+type scanOptions struct {
+	pattern  string // Empty to return everything
+	count    int
+	typ      string // SCAN only, empty for any type
+	noValues bool   // HSCAN only
+}
+
+// parseScan parses the cursor and the options of a SCAN family command. The
+// options allowed besides MATCH and COUNT are given in extra.
+func parseScan(args []resp.Value, extra string) (uint64, scanOptions, *resp.Value) {
+	opts := scanOptions{count: 10}
+	cursor, err := strconv.ParseUint(args[0].Bulk, 10, 64)
+	if err != nil {
+		return 0, opts, &resp.Value{Typ: "error", Str: "ERR invalid cursor"}
+	}
+
+	syntaxErr := &resp.Value{Typ: "error", Str: "ERR syntax error"}
+	for i := 1; i < len(args); i++ {
+		option := strings.ToUpper(args[i].Bulk)
+		if option == "NOVALUES" && extra == option {
+			opts.noValues = true
+			continue
+		}
+		if i+1 == len(args) {
+			return 0, opts, syntaxErr
+		}
+		i++
+		switch {
+		case option == "MATCH":
+			opts.pattern = args[i].Bulk
+			if opts.pattern == "*" {
+				opts.pattern = ""
+			}
+		case option == "COUNT":
+			count, err := strconv.Atoi(args[i].Bulk)
+			if err != nil {
+				return 0, opts, &resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+			}
+			if count < 1 {
+				return 0, opts, syntaxErr
+			}
+			opts.count = count
+		case option == "TYPE" && extra == option:
+			opts.typ = strings.ToLower(args[i].Bulk)
+			if !scanTypes[opts.typ] {
+				return 0, opts, &resp.Value{Typ: "error", Str: fmt.Sprintf("ERR unknown type name '%s'", args[i].Bulk)}
+			}
+		default:
+			return 0, opts, syntaxErr
+		}
+	}
+	return cursor, opts, nil
+}
+
+// scanDict walks d from cursor until it has gone through at least count
+// entries, or ten times as many buckets turned out empty, or it reached the
+// end. It returns the cursor to continue from and the entries it saw.
+func scanDict[V any](d *dict[V], cursor uint64, count int, fn func(key string, value V)) uint64 {
+	seen := 0
+	for tries := count * 10; ; tries-- {
+		cursor = d.scan(cursor, func(key string, value V) {
+			fn(key, value)
+			seen++
+		})
+		if cursor == 0 || tries == 0 || seen >= count {
+			return cursor
+		}
+	}
+}
+
+// scanReply builds the reply of the SCAN family: the next cursor followed by
+// the elements found.
+func scanReply(cursor uint64, elements []resp.Value) resp.Value {
+	return resp.Value{Typ: "array", Array: []resp.Value{
+		{Typ: "bulk", Bulk: strconv.FormatUint(cursor, 10)},
+		{Typ: "array", Array: elements},
+	}}
+}
+
+// scan implements SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]. A
+// full iteration starts at cursor 0 and ends when 0 is returned again. Every
+// key that exists for the whole iteration is returned, whatever happens to the
+// others in between, but a key may be returned more than once.
+func scan(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'scan' command"}
+	}
+	cursor, opts, errValue := parseScan(args, "TYPE")
+	if errValue != nil {
+		return *errValue
+	}
+
+	keyspaceMu.RLock()
+	defer keyspaceMu.RUnlock()
+
+	now := time.Now()
+	result := []resp.Value{}
+	cursor = scanDict(db.keys, cursor, opts.count, func(key string, obj *Object) {
+		if obj.expired(now) || (opts.typ != "" && obj.Type != opts.typ) {
+			return
+		}
+		if opts.pattern == "" || globMatch(opts.pattern, key) {
+			result = append(result, resp.Value{Typ: "bulk", Bulk: key})
+		}
+	})
+	return scanReply(cursor, result)
+}
+
+// hscan implements HSCAN key cursor [MATCH pattern] [COUNT count] [NOVALUES],
+// SCAN over the fields of a hash. It replies with the fields found and their
+// values, or only the fields with NOVALUES.
+func hscan(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'hscan' command"}
+	}
+	cursor, opts, errValue := parseScan(args[1:], "NOVALUES")
+	if errValue != nil {
+		return *errValue
+	}
+
+	keyspaceMu.RLock()
+	defer keyspaceMu.RUnlock()
+
+	obj := db.lookupKey(args[0].Bulk)
+	if obj == nil {
+		return scanReply(0, []resp.Value{})
+	}
+	if obj.Type != typeHash {
+		return wrongType
+	}
+
+	now := time.Now()
+	result := []resp.Value{}
+	cursor = scanDict(obj.Hash, cursor, opts.count, func(field, value string) {
+		if obj.fieldExpired(field, now) {
+			return
+		}
+		if opts.pattern != "" && !globMatch(opts.pattern, field) {
+			return
+		}
+		result = append(result, resp.Value{Typ: "bulk", Bulk: field})
+		if !opts.noValues {
+			result = append(result, resp.Value{Typ: "bulk", Bulk: value})
+		}
+	})
+	return scanReply(cursor, result)
+}
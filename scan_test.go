@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// command runs a command against db the way a client would, without the AOF.
+func command(db *Keyspace, name string, args ...string) resp.Value {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.Value{Typ: "bulk", Bulk: arg}
+	}
+	return Handlers[name](db, values)
+}
+
+// scanAll runs a SCAN family command from cursor 0 until it returns 0 again,
+// calling between before every call. It returns the elements of every reply.
+// key is left out of the arguments when empty, for SCAN itself.
+func scanAll(t *testing.T, db *Keyspace, name, key string, options []string, between func()) []string {
+	t.Helper()
+	var elements []string
+	cursor := "0"
+	for calls := 0; ; calls++ {
+		if calls > 100000 {
+			t.Fatalf("%s never returned cursor 0", name)
+		}
+		between()
+		args := append([]string{cursor}, options...)
+		if key != "" {
+			args = append([]string{key}, args...)
+		}
+		reply := command(db, name, args...)
+		if reply.Typ != "array" {
+			t.Fatalf("%s %q: got %v", name, args, reply)
+		}
+		cursor = reply.Array[0].Bulk
+		for _, element := range reply.Array[1].Array {
+			elements = append(elements, element.Bulk)
+		}
+		if cursor == "0" {
+			return elements
+		}
+	}
+}
+
+func TestScanWhileKeysChange(t *testing.T) {
+	db := newKeyspace(0)
+	for i := range 200 {
+		db.set(fmt.Sprintf("stable:%d", i), newString("v"))
+	}
+
+	calls, added := 0, 0
+	found := scanAll(t, db, "SCAN", "", []string{"COUNT", "7"}, func() {
+		calls++
+		switch {
+		case calls < 20:
+			for range 100 {
+				db.set(fmt.Sprintf("temp:%d", added), newString("v"))
+				added++
+			}
+		case added > 0:
+			for range 150 {
+				if added > 0 {
+					added--
+					db.delete(fmt.Sprintf("temp:%d", added))
+				}
+			}
+		}
+	})
+
+	for i := range 200 {
+		if key := fmt.Sprintf("stable:%d", i); !slices.Contains(found, key) {
+			t.Errorf("%q was never returned", key)
+		}
+	}
+}
+
+func TestScanOptions(t *testing.T) {
+	db := newKeyspace(0)
+	db.set("user:1", newString("a"))
+	db.set("user:2", newString("b"))
+	db.set("user:list", newList())
+	db.set("session:1", newHash())
+	gone := newString("c")
+	gone.HasExpiry = true
+	gone.Begone = time.Now().Add(-time.Second)
+	db.set("user:gone", gone)
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"session:1", "user:1", "user:2", "user:list"}},
+		{[]string{"MATCH", "*"}, []string{"session:1", "user:1", "user:2", "user:list"}},
+		{[]string{"MATCH", "user:?"}, []string{"user:1", "user:2"}},
+		{[]string{"match", "user:*", "count", "1"}, []string{"user:1", "user:2", "user:list"}},
+		{[]string{"TYPE", "list"}, []string{"user:list"}},
+		{[]string{"TYPE", "HASH", "MATCH", "user:*"}, nil},
+		{[]string{"TYPE", "zset"}, nil},
+	}
+	for _, tt := range tests {
+		got := scanAll(t, db, "SCAN", "", tt.args, func() {})
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("SCAN %q = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestScanErrors(t *testing.T) {
+	db := newKeyspace(0)
+	db.set("string", newString("v"))
+	for _, tt := range []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"SCAN", nil, "ERR wrong number of arguments for 'scan' command"},
+		{"SCAN", []string{"x"}, "ERR invalid cursor"},
+		{"SCAN", []string{"-1"}, "ERR invalid cursor"},
+		{"SCAN", []string{"0", "COUNT"}, "ERR syntax error"},
+		{"SCAN", []string{"0", "COUNT", "0"}, "ERR syntax error"},
+		{"SCAN", []string{"0", "COUNT", "x"}, "ERR value is not an integer or out of range"},
+		{"SCAN", []string{"0", "TYPE", "blob"}, "ERR unknown type name 'blob'"},
+		{"SCAN", []string{"0", "NOVALUES"}, "ERR syntax error"},
+		{"HSCAN", []string{"string"}, "ERR wrong number of arguments for 'hscan' command"},
+		{"HSCAN", []string{"string", "0"}, wrongType.Str},
+		{"HSCAN", []string{"string", "0", "TYPE", "hash"}, "ERR syntax error"},
+	} {
+		if got := command(db, tt.name, tt.args...); got.Typ != "error" || got.Str != tt.want {
+			t.Errorf("%s %q = %v, want %q", tt.name, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestHscan(t *testing.T) {
+	db := newKeyspace(0)
+	for i := range 300 {
+		command(db, "HSET", "hash", fmt.Sprintf("f%d", i), fmt.Sprintf("v%d", i))
+	}
+
+	pairs := scanAll(t, db, "HSCAN", "hash", []string{"MATCH", "f1?"}, func() {})
+	if len(pairs)%2 != 0 {
+		t.Fatalf("HSCAN returned %d elements, want pairs", len(pairs))
+	}
+	got := make(map[string]string)
+	for i := 0; i < len(pairs); i += 2 {
+		got[pairs[i]] = pairs[i+1]
+	}
+	want := make(map[string]string)
+	for i := 10; i < 20; i++ {
+		want[fmt.Sprintf("f%d", i)] = fmt.Sprintf("v%d", i)
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("HSCAN MATCH f1? = %q, want %q", got, want)
+	}
+
+	fields := scanAll(t, db, "HSCAN", "hash", []string{"NOVALUES", "COUNT", "50"}, func() {})
+	slices.Sort(fields)
+	fields = slices.Compact(fields)
+	if len(fields) != 300 || fields[0] != "f0" {
+		t.Errorf("HSCAN NOVALUES returned %d fields starting with %q, want the 300 fields", len(fields), fields[0])
+	}
+
+	if got := scanAll(t, db, "HSCAN", "missing", nil, func() {}); len(got) != 0 {
+		t.Errorf("HSCAN of a missing key = %q, want nothing", got)
+	}
+}
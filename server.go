@@ -0,0 +1,709 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// Commands that modify the dataset. They are executed one at a time under
+// writeMu and appended to the AOF once they succeed, so that the order of the
+// log always matches the order in which the changes were applied.
+var writeCommands = map[string]bool{
+	"SET":         true,
+	"SETNX":       true,
+	"SETEX":       true,
+	"PSETEX":      true,
+	"GETSET":      true,
+	"GETEX":       true,
+	"GETDEL":      true,
+	"MSET":        true,
+	"MSETNX":      true,
+	"INCR":        true,
+	"INCRBY":      true,
+	"DECR":        true,
+	"DECRBY":      true,
+	"INCRBYFLOAT": true,
+	"APPEND":      true,
+	"SETRANGE":    true,
+	"HSET":        true,
+	"HDEL":        true,
+	"HEXPIRE":     true,
+	"HPEXPIRE":    true,
+	"HEXPIREAT":   true,
+	"HPEXPIREAT":  true,
+	"HPERSIST":    true,
+	"LPUSH":       true,
+	"RPUSH":       true,
+	"LPOP":        true,
+	"RPOP":        true,
+	"BLPOP":       true,
+	"EXPIRE":      true,
+	"PEXPIRE":     true,
+	"EXPIREAT":    true,
+	"PEXPIREAT":   true,
+	"PERSIST":     true,
+	"DEL":         true,
+	"UNLINK":      true,
+	"RENAME":      true,
+	"RENAMENX":    true,
+	"COPY":        true,
+	"MOVE":        true,
+	"SWAPDB":      true,
+	"FLUSHDB":     true,
+	"FLUSHALL":    true,
+}
+
+// writeMu serializes write commands across all connections. Readers do not
+// take it, they only rely on keyspaceMu.
+var writeMu sync.Mutex
+
+// shutdown is closed when the server starts shutting down so that commands
+// which block (BLPOP) can give up early instead of holding the server open.
+var shutdown = make(chan struct{})
+
+// Client holds the state that belongs to a single connection. Every client is
+// served by its own goroutine with its own reader and writer.
+type Client struct {
+	id     int64
+	name   string
+	db     int // Database selected with SELECT
+	server *Server
+	conn   net.Conn
+	resp   *resp.Resp
+	writer *resp.Writer
+}
+
+// Commands that act on the connection itself or on the server behind it rather
+// than on the dataset. They get the client they were sent on next to their
+// arguments.
+var clientHandlers = map[string]func(*Client, []resp.Value) resp.Value{
+	"PING":         ping,
+	"HELLO":        hello,
+	"SELECT":       selectHandler,
+	"CONFIG":       configHandler,
+	"BGREWRITEAOF": bgrewriteaof,
+	"SAVE":         save,
+	"BGSAVE":       bgsave,
+	"LASTSAVE":     lastsave,
+	"INFO":         info,
+}
+
+// Reported to clients by HELLO.
+const version = "0.1.0"
+
+type Server struct {
+	listener net.Listener
+	aof      *Aof
+
+	mu      sync.Mutex
+	clients map[*Client]struct{}
+	closing bool
+	wg      sync.WaitGroup
+	nextID  atomic.Int64
+	started time.Time
+
+	expireDB int // Database the next active expiry cycle starts with
+
+	dirty      atomic.Int64 // Changes since the last successful save
+	saveMu     sync.Mutex
+	saving     bool      // A save (SAVE or BGSAVE) is in progress
+	lastSave   time.Time // Last successful save, or startup
+	lastSaveOK bool      // Whether the last save attempt succeeded
+	lastTry    time.Time // Last save attempt
+	bgsaves    sync.WaitGroup
+}
+
+func NewServer(l net.Listener, aof *Aof) *Server {
+	return &Server{
+		listener:   l,
+		aof:        aof,
+		clients:    make(map[*Client]struct{}),
+		started:    time.Now(),
+		lastSave:   time.Now(),
+		lastSaveOK: true,
+	}
+}
+
+// Serve accepts connections until the listener is closed. Each connection is
+// handed over to its own goroutine so that a slow or idle client never holds
+// up the others.
+func (s *Server) Serve() error {
+	go s.cron()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return nil
+			}
+			return err
+		}
+
+		client := &Client{
+			id:     s.nextID.Add(1),
+			server: s,
+			conn:   conn,
+			resp:   resp.NewResp(conn),
+			writer: resp.NewWriter(conn),
+		}
+
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.clients[client] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveClient(client)
+	}
+}
+
+// Close stops accepting new connections, disconnects every client and waits
+// for their goroutines to finish. The AOF is left open for the caller to close
+// once no more commands can reach it.
+func (s *Server) Close() error {
+	var err error
+	s.mu.Lock()
+	if !s.closing {
+		s.closing = true
+		close(shutdown)
+		err = s.listener.Close()
+		for client := range s.clients {
+			client.conn.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serveClient(client *Client) {
+	defer func() {
+		client.conn.Close()
+		s.mu.Lock()
+		delete(s.clients, client)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	fmt.Println("Client", client.id, "connected from", client.conn.RemoteAddr())
+
+	// Keep reading commands from this client until it disconnects
+	for {
+		value, err := client.resp.Read()
+		if err != nil {
+			if err == io.EOF {
+				fmt.Println("Client", client.id, "disconnected from Bluedis server.")
+				return
+			}
+			// After a protocol error we can no longer tell where the next
+			// request starts, so tell the client why and drop the connection
+			var protoErr resp.ProtocolError
+			if errors.As(err, &protoErr) {
+				client.writer.Write(resp.Value{Typ: "error", Str: "ERR " + protoErr.Error()})
+				client.writer.Flush()
+			}
+			fmt.Println(err)
+			return
+		}
+
+		client.process(s, value)
+
+		// Replies are only flushed once every pipelined command received so
+		// far has been answered, so a batch of N commands costs one write
+		// instead of N. Replies are queued in the order the commands arrived.
+		if client.resp.Buffered() == 0 {
+			if err := client.writer.Flush(); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+	}
+}
+
+// process executes a single request and queues its reply on the client's
+// writer.
+func (client *Client) process(s *Server, value resp.Value) {
+	if value.Typ != "array" {
+		fmt.Println("Invalid request, expected array")
+		return
+	}
+
+	if len(value.Array) == 0 {
+		fmt.Println("Invalid request, expected array length > 0")
+		return
+	}
+
+	command := strings.ToUpper(value.Array[0].Bulk)
+	args := value.Array[1:]
+
+	// Redis sends an initial command when connecting, handling it
+	if command == "COMMAND" || command == "RETRY" {
+		client.writer.Write(resp.Value{Typ: "string", Str: ""})
+		return
+	}
+	if handler, ok := clientHandlers[command]; ok {
+		client.writer.Write(handler(client, args))
+		return
+	}
+	if _, ok := Handlers[command]; !ok {
+		fmt.Println("Invalid command: ", command)
+		client.writer.Write(resp.Value{Typ: "string", Str: ""})
+		return
+	}
+
+	// A blocking command may wait for a long time, so whatever was queued for
+	// the earlier commands of the pipeline is sent out first
+	var gone <-chan struct{}
+	if blockingCommands[command] != nil {
+		client.writer.Flush()
+		var stop func()
+		gone, stop = client.watchDisconnect()
+		defer stop()
+	}
+
+	client.writer.Write(s.call(databases[client.db], command, args, gone))
+}
+
+// watchDisconnect returns a channel that is closed if the client disconnects
+// while a blocking command waits on its behalf, and a function to call before
+// the connection is read again. Commands the client pipelines, before or after
+// the blocking one, are kept in the reader for after it, without keeping a
+// disconnect from being noticed.
+func (client *Client) watchDisconnect() (<-chan struct{}, func()) {
+	gone := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := client.resp.Drain()
+		var netErr net.Error
+		if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			close(gone)
+		}
+	}()
+
+	stop := func() {
+		// An expired deadline wakes Drain up without closing the connection
+		client.conn.SetReadDeadline(time.Now())
+		<-done
+		client.conn.SetReadDeadline(time.Time{})
+	}
+	return gone, stop
+}
+
+// call executes a command on db. Write commands hold writeMu for the duration
+// of the handler and the AOF append so that concurrent clients can never get
+// their changes logged in a different order than they were applied. Handlers
+// never take or release writeMu themselves, blocking commands included (see
+// blockingCommands), which give up once gone is closed.
+func (s *Server) call(db *Keyspace, command string, args []resp.Value, gone <-chan struct{}) resp.Value {
+	handler := Handlers[command]
+	if !writeCommands[command] {
+		return handler(db, args)
+	}
+	if timeout := blockingCommands[command]; timeout != nil {
+		return s.callBlocking(db, command, args, timeout, gone)
+	}
+	return s.callWrite(db, command, args)
+}
+
+// callWrite runs a write command under writeMu and logs it.
+func (s *Server) callWrite(db *Keyspace, command string, args []resp.Value) resp.Value {
+	writeMu.Lock()
+	result := Handlers[command](db, args)
+	s.propagateExpired(takeExpiredKeys())
+	s.propagate(db, command, args, result)
+	writeMu.Unlock()
+
+	// With appendfsync always the reply has to wait for the fsync. That
+	// happens outside writeMu so that concurrent writers share one fsync.
+	if s.aof != nil {
+		if err := s.aof.Commit(); err != nil {
+			fmt.Println("Error syncing the AOF:", err)
+		}
+	}
+	return result
+}
+
+// blockingCommands are the write commands that wait for another client to
+// give them something to do. Their handler makes a single attempt, replying
+// null when it found nothing, and the function returns how long the command
+// may keep trying given its arguments (already checked by the handler), 0
+// meaning for as long as it takes.
+var blockingCommands = map[string]func(args []resp.Value) (time.Duration, bool){
+	"BLPOP": blpopTimeout,
+}
+
+// callBlocking retries a blocking command every 50ms until it does something,
+// its timeout expires, the client is gone or the server shuts down. writeMu is
+// only held during each attempt, so that other clients can push in between.
+func (s *Server) callBlocking(db *Keyspace, command string, args []resp.Value, timeoutOf func([]resp.Value) (time.Duration, bool), gone <-chan struct{}) resp.Value {
+	result := s.callWrite(db, command, args)
+	if result.Typ != "null" {
+		return result
+	}
+	timeout, _ := timeoutOf(args)
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	// Without a timeout the timer channel stays nil and never fires
+	var timerC <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timerC = timer.C
+	}
+
+	for {
+		select {
+		case <-timerC:
+			return resp.Value{Typ: "null"}
+		case <-gone:
+			return resp.Value{Typ: "null"}
+		case <-shutdown:
+			return resp.Value{Typ: "null"}
+		case <-ticker.C:
+		}
+		result = s.callWrite(db, command, args)
+		if result.Typ != "null" {
+			return result
+		}
+	}
+}
+
+// propagate records a successfully executed write command: it counts as one
+// change towards the save rules and is appended to the AOF when enabled.
+func (s *Server) propagate(db *Keyspace, command string, args []resp.Value, result resp.Value) {
+	entries := aofEntries(db, command, args, result)
+	if len(entries) == 0 {
+		return
+	}
+
+	s.dirty.Add(1)
+	if s.aof == nil {
+		return
+	}
+	if err := s.aof.WriteDB(db.id, entries...); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// propagateExpired records the deletion of keys that expired, as one DEL
+// each. The caller holds writeMu.
+func (s *Server) propagateExpired(keys []expiredKey) {
+	stats.expiredKeys.Add(int64(len(keys)))
+	for len(keys) > 0 {
+		db := keys[0].db
+		var entries []resp.Value
+		for len(keys) > 0 && keys[0].db == db {
+			entries = append(entries, commandValue("DEL", resp.Value{Typ: "bulk", Bulk: keys[0].key}))
+			keys = keys[1:]
+		}
+		s.propagateDeletions(db, entries)
+	}
+}
+
+// propagateDeletions records deletions the server made on its own in database
+// db, such as those of expired keys and fields, as one change per entry. The
+// caller holds writeMu.
+func (s *Server) propagateDeletions(db int, entries []resp.Value) {
+	if len(entries) == 0 {
+		return
+	}
+
+	s.dirty.Add(int64(len(entries)))
+	if s.aof == nil {
+		return
+	}
+	if err := s.aof.WriteDB(db, entries...); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// aofEntries returns the commands to append to the AOF for a write command
+// that just ran, none if it did not change anything. Commands are rewritten
+// when their effect would not be the same if replayed later.
+func aofEntries(db *Keyspace, command string, args []resp.Value, result resp.Value) []resp.Value {
+	if result.Typ == "error" {
+		return nil
+	}
+
+	switch command {
+	case "SET", "SETNX", "SETEX", "PSETEX", "GETSET", "INCRBYFLOAT":
+		if !stringSet(command, args, result) {
+			return nil
+		}
+		// The deadline is logged as an absolute time (see expireValue),
+		// and the result of INCRBYFLOAT as the value it left. A deadline in
+		// the past left no key.
+		key := args[0].Bulk
+		keyspaceMu.RLock()
+		obj, ok := db.get(key)
+		var value Object
+		if ok {
+			value = *obj
+		}
+		keyspaceMu.RUnlock()
+		if !ok {
+			return []resp.Value{commandValue("DEL", args[0])}
+		}
+		entries := []resp.Value{commandValue("SET", args[0], resp.Value{Typ: "bulk", Bulk: value.Content})}
+		if value.HasExpiry {
+			entries = append(entries, expireValue(key, value.Begone))
+		}
+		return entries
+	case "GETEX":
+		// GETEX without options only reads the key
+		if result.Typ == "null" {
+			return nil
+		}
+		opts, _ := parseSetOptions(args[1:], true)
+		switch {
+		case opts.persist:
+			return []resp.Value{commandValue("PERSIST", args[0])}
+		case opts.expiry != "":
+			return expiryEntries(db, args[0])
+		}
+		return nil
+	case "MSETNX":
+		// Whether the keys exist when replaying may differ, since expired
+		// keys are kept while loading, so the keys that were set are
+		// logged as the MSET it turned into
+		if result.Num == 0 {
+			return nil
+		}
+		return []resp.Value{commandValue("MSET", args...)}
+	case "GETDEL":
+		if result.Typ == "null" {
+			return nil
+		}
+		return []resp.Value{commandValue("DEL", args[0])}
+	case "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT":
+		if result.Num != 1 {
+			return nil
+		}
+		return expiryEntries(db, args[0])
+	case "HEXPIRE", "HPEXPIRE", "HEXPIREAT", "HPEXPIREAT":
+		return hexpireEntries(db, args, result)
+	case "HPERSIST":
+		for _, reply := range result.Array {
+			if reply.Num == 1 {
+				return []resp.Value{commandValue(command, args...)}
+			}
+		}
+		return nil
+	case "DEL", "UNLINK", "RENAMENX", "COPY", "PERSIST", "HDEL", "MOVE":
+		if result.Num == 0 {
+			return nil
+		}
+		return []resp.Value{commandValue(command, args...)}
+	case "LPOP", "RPOP":
+		// Nothing was popped, so there is nothing to replay
+		if result.Typ == "null" {
+			return nil
+		}
+		return []resp.Value{commandValue(command, args...)}
+	case "BLPOP":
+		// Only the pop itself matters. It is logged as the LPOP it turned
+		// into, so replaying it never has to block or guess which key won.
+		if result.Typ == "null" {
+			return nil
+		}
+		return []resp.Value{commandValue("LPOP", result.Array[0])}
+	case "SETRANGE":
+		// An empty value only reads the length of the string
+		if args[2].Bulk == "" {
+			return nil
+		}
+		return []resp.Value{commandValue(command, args...)}
+	default:
+		return []resp.Value{commandValue(command, args...)}
+	}
+}
+
+// expiryEntries returns the AOF entries of a command that gave key a
+// deadline: a PEXPIREAT, or a DEL when the deadline was in the past and
+// removed the key instead of expiring it.
+func expiryEntries(db *Keyspace, key resp.Value) []resp.Value {
+	keyspaceMu.RLock()
+	value, ok := db.get(key.Bulk)
+	keyspaceMu.RUnlock()
+	if !ok {
+		return []resp.Value{commandValue("DEL", key)}
+	}
+	return []resp.Value{expireValue(key.Bulk, value.Begone)}
+}
+
+// commandValue builds the RESP array for a command and its arguments, the
+// form in which commands are appended to the AOF.
+func commandValue(command string, args ...resp.Value) resp.Value {
+	entry := resp.Value{Typ: "array", Array: make([]resp.Value, 0, len(args)+1)}
+	entry.Array = append(entry.Array, resp.Value{Typ: "bulk", Bulk: command})
+	entry.Array = append(entry.Array, args...)
+	return entry
+}
+
+// hello implements HELLO [protover [AUTH username password] [SETNAME name]].
+// It switches the connection between RESP2 and RESP3 and replies with a map
+// describing the server, encoded with the newly selected protocol.
+func hello(client *Client, args []resp.Value) resp.Value {
+	proto := client.writer.Protocol()
+	if len(args) > 0 {
+		ver, err := strconv.Atoi(args[0].Bulk)
+		if err != nil {
+			return resp.Value{Typ: "error", Str: "ERR Protocol version is not an integer or out of range"}
+		}
+		if ver != 2 && ver != 3 {
+			return resp.Value{Typ: "error", Str: "NOPROTO unsupported protocol version"}
+		}
+		proto = ver
+	}
+
+	name, setName := "", false
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Bulk) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				return resp.Value{Typ: "error", Str: "ERR Syntax error in HELLO option 'auth'"}
+			}
+			// There is no password support, so only the default user exists
+			// and it accepts any password, same as Redis without requirepass
+			if args[i+1].Bulk != "default" {
+				return resp.Value{Typ: "error", Str: "WRONGPASS invalid username-password pair or user is disabled."}
+			}
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return resp.Value{Typ: "error", Str: "ERR Syntax error in HELLO option 'setname'"}
+			}
+			name, setName = args[i+1].Bulk, true
+			if strings.ContainsAny(name, " \n") {
+				return resp.Value{Typ: "error", Str: "ERR Client names cannot contain spaces, newlines or special characters."}
+			}
+			i++
+		default:
+			return resp.Value{Typ: "error", Str: fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i].Bulk)}
+		}
+	}
+
+	// Nothing is changed until every option has been validated
+	client.writer.SetProtocol(proto)
+	if setName {
+		client.name = name
+	}
+
+	return resp.Value{Typ: "map", Array: []resp.Value{
+		{Typ: "bulk", Bulk: "server"}, {Typ: "bulk", Bulk: "bluedis"},
+		{Typ: "bulk", Bulk: "version"}, {Typ: "bulk", Bulk: version},
+		{Typ: "bulk", Bulk: "proto"}, {Typ: "integer", Num: proto},
+		{Typ: "bulk", Bulk: "id"}, {Typ: "integer", Num: int(client.id)},
+		{Typ: "bulk", Bulk: "mode"}, {Typ: "bulk", Bulk: "standalone"},
+		{Typ: "bulk", Bulk: "role"}, {Typ: "bulk", Bulk: "master"},
+		{Typ: "bulk", Bulk: "modules"}, {Typ: "array", Array: []resp.Value{}},
+	}}
+}
+
+// cron runs the periodic background jobs until the server shuts down.
+func (s *Server) cron() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-ticker.C:
+			s.activeExpireCycle()
+			s.saveIfNeeded()
+			s.rewriteAOFIfNeeded()
+		}
+	}
+}
+
+// rewriteAOFIfNeeded starts a rewrite once the AOF has grown by
+// auto-aof-rewrite-percentage since the last one, as long as it is at least
+// auto-aof-rewrite-min-size big.
+func (s *Server) rewriteAOFIfNeeded() {
+	config.mu.RLock()
+	perc, minSize := config.autoAofRewritePercentage, config.autoAofRewriteMinSize
+	config.mu.RUnlock()
+
+	if s.aof == nil || perc == 0 || s.aof.Rewriting() {
+		return
+	}
+
+	current, base := s.aof.Size()
+	if current < minSize {
+		return
+	}
+	if base == 0 {
+		base = 1
+	}
+	growth := (current - base) * 100 / base
+	if growth >= perc {
+		fmt.Printf("Starting automatic rewriting of AOF on %d%% growth\n", growth)
+		if err := s.BackgroundRewriteAOF(); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// BackgroundRewriteAOF compacts the AOF into the minimal list of commands that
+// rebuilds the current dataset. Only copying the dataset stops the writers,
+// the new file is written in the background.
+func (s *Server) BackgroundRewriteAOF() error {
+	if s.aof == nil {
+		return errors.New("ERR append only file is disabled, set 'appendonly yes' at startup")
+	}
+
+	writeMu.Lock()
+	if err := s.aof.BeginRewrite(); err != nil {
+		writeMu.Unlock()
+		return err
+	}
+	ds := copyDataset()
+	writeMu.Unlock()
+
+	config.mu.RLock()
+	dump := ds.rewriteCommands
+	if config.aofUseRDBPreamble {
+		dump = ds.WriteSnapshot
+	}
+	config.mu.RUnlock()
+
+	go func() {
+		start := time.Now()
+		if err := s.aof.CompleteRewrite(dump); err != nil {
+			fmt.Println("Background AOF rewrite failed:", err)
+			return
+		}
+		fmt.Printf("Background AOF rewrite finished successfully in %.3f seconds\n", time.Since(start).Seconds())
+	}()
+	return nil
+}
+
+func bgrewriteaof(client *Client, args []resp.Value) resp.Value {
+	if len(args) != 0 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'bgrewriteaof' command"}
+	}
+	if err := client.server.BackgroundRewriteAOF(); err != nil {
+		return resp.Value{Typ: "error", Str: err.Error()}
+	}
+	return resp.Value{Typ: "string", Str: "Background append only file rewriting started"}
+}
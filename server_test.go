@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// connect serves one end of a pipe the way Serve does with a connection it
+// accepted, and returns the other end.
+func connect(s *Server) net.Conn {
+	if databases == nil {
+		initDatabases(16)
+	}
+	conn, peer := net.Pipe()
+	client := &Client{
+		id:     s.nextID.Add(1),
+		server: s,
+		conn:   peer,
+		resp:   resp.NewResp(peer),
+		writer: resp.NewWriter(peer),
+	}
+	s.clients[client] = struct{}{}
+	s.wg.Add(1)
+	go s.serveClient(client)
+	return conn
+}
+
+// request returns the command made of args as a client sends it.
+func request(args ...string) []byte {
+	request := resp.Value{Typ: "array"}
+	for _, arg := range args {
+		request.Array = append(request.Array, resp.Value{Typ: "bulk", Bulk: arg})
+	}
+	return request.Marshal()
+}
+
+func send(t *testing.T, conn net.Conn, args ...string) {
+	t.Helper()
+	if _, err := conn.Write(request(args...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A timeout of 0 waits until an element arrives, well past the retries.
+func TestBlpopWithoutTimeout(t *testing.T) {
+	s := NewServer(nil, nil)
+	conn := connect(s)
+	defer conn.Close()
+
+	send(t, conn, "BLPOP", "blpop:forever", "0")
+	replies := resp.NewResp(conn)
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if reply, err := replies.Read(); err == nil {
+		t.Fatalf("BLPOP replied %v before anything was pushed", reply)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	s.call(databases[0], "RPUSH", []resp.Value{{Typ: "bulk", Bulk: "blpop:forever"}, {Typ: "bulk", Bulk: "a"}}, nil)
+	reply, err := replies.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Array) != 2 || reply.Array[0].Bulk != "blpop:forever" || reply.Array[1].Bulk != "a" {
+		t.Errorf("BLPOP = %v, want [blpop:forever a]", reply)
+	}
+}
+
+// A client that disconnects while blocked is let go and pops nothing later.
+func TestBlpopClientGone(t *testing.T) {
+	s := NewServer(nil, nil)
+	conn := connect(s)
+
+	send(t, conn, "BLPOP", "blpop:gone", "0")
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client is still blocked after disconnecting")
+	}
+
+	s.call(databases[0], "RPUSH", []resp.Value{{Typ: "bulk", Bulk: "blpop:gone"}, {Typ: "bulk", Bulk: "a"}}, nil)
+	time.Sleep(100 * time.Millisecond)
+	wantInteger(t, command(databases[0], "LLEN", "blpop:gone"), 1, "LLEN blpop:gone")
+}
+
+// A command pipelined after BLPOP neither hides a disconnect nor gets lost
+// while the client stays.
+func TestBlpopPipelined(t *testing.T) {
+	s := NewServer(nil, nil)
+	conn := connect(s)
+	if _, err := conn.Write(append(request("BLPOP", "p:gone", "0"), request("PING")...)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client is still blocked after disconnecting")
+	}
+
+	s.call(databases[0], "RPUSH", []resp.Value{{Typ: "bulk", Bulk: "p:gone"}, {Typ: "bulk", Bulk: "a"}}, nil)
+	time.Sleep(100 * time.Millisecond)
+	wantInteger(t, command(databases[0], "LLEN", "p:gone"), 1, "LLEN p:gone")
+
+	conn = connect(s)
+	defer conn.Close()
+	if _, err := conn.Write(append(request("BLPOP", "p:stay", "0"), request("PING")...)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	send(t, conn, "PING", "after")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	s.call(databases[0], "RPUSH", []resp.Value{{Typ: "bulk", Bulk: "p:stay"}, {Typ: "bulk", Bulk: "a"}}, nil)
+	want := "*2\r\n$6\r\np:stay\r\n$1\r\na\r\n+PONG\r\n+after\r\n"
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("replied %q, want %q", got, want)
+	}
+}
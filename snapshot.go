@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	appendonly "github.com/IAmRiteshKoushik/bluedis/aof"
+)
+
+// Formats SAVE and BGSAVE can write, see the snapshot-format parameter.
+// Loading detects the format on its own.
+const (
+	snapshotFormatBluedis = "bluedis"
+	snapshotFormatRedis   = "redis"
+)
+
+// WriteSnapshot encodes the dataset in the snapshot format (see
+// appendonly.SnapshotWriter).
+func (ds *Dataset) WriteSnapshot(w io.Writer) error {
+	sw := appendonly.NewSnapshotWriter(w)
+
+	for _, i := range ds.indexes() {
+		for key, obj := range ds.dbs[i] {
+			rec := appendonly.SnapshotRecord{DB: i, Key: key}
+			switch obj.Type {
+			case typeString:
+				rec.Type = appendonly.SnapshotTypeString
+				rec.Values = []string{obj.Content}
+			case typeHash:
+				rec.Type = appendonly.SnapshotTypeHash
+				if len(obj.FieldExpires) > 0 {
+					rec.Type = appendonly.SnapshotTypeHashTTL
+				}
+				rec.Values = make([]string, 0, 2*obj.Hash.len())
+				for field, value := range obj.Hash.all() {
+					rec.Values = append(rec.Values, field, value)
+					if rec.Type == appendonly.SnapshotTypeHashTTL {
+						rec.FieldDeadlines = append(rec.FieldDeadlines, obj.FieldExpires[field])
+					}
+				}
+			case typeList:
+				rec.Type = appendonly.SnapshotTypeList
+				rec.Values = obj.elements()
+			}
+			if obj.HasExpiry {
+				rec.Deadline = obj.Begone
+			}
+			sw.WriteRecord(rec)
+		}
+	}
+
+	return sw.Close()
+}
+
+// ReadSnapshot decodes a snapshot written by WriteSnapshot. Keys and fields
+// whose deadline already passed are left out.
+func ReadSnapshot(r io.Reader) (*Dataset, error) {
+	ds := newDataset()
+
+	now := time.Now()
+	_, err := appendonly.ScanSnapshot(bufio.NewReader(r), func(rec appendonly.SnapshotRecord) {
+		var obj *Object
+		switch rec.Type {
+		case appendonly.SnapshotTypeString:
+			obj = newString(rec.Values[0])
+		case appendonly.SnapshotTypeHash, appendonly.SnapshotTypeHashTTL:
+			obj = newHash()
+			for i := 0; i < len(rec.Values); i += 2 {
+				field := rec.Values[i]
+				if rec.Type == appendonly.SnapshotTypeHashTTL {
+					if deadline := rec.FieldDeadlines[i/2]; !deadline.IsZero() {
+						if now.After(deadline) {
+							continue
+						}
+						if obj.FieldExpires == nil {
+							obj.FieldExpires = make(map[string]time.Time)
+						}
+						obj.FieldExpires[field] = deadline
+					}
+				}
+				obj.Hash.set(field, rec.Values[i+1])
+			}
+			if obj.Hash.len() == 0 {
+				return
+			}
+		case appendonly.SnapshotTypeList:
+			obj = newList()
+			for _, element := range rec.Values {
+				obj.List.PushRight(element)
+			}
+		}
+		if !rec.Deadline.IsZero() {
+			obj.HasExpiry = true
+			obj.Begone = rec.Deadline
+		}
+		if !obj.expired(now) {
+			ds.db(rec.DB)[rec.Key] = obj
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// saveSnapshot writes the dataset to path in the given format. It goes to a
+// temporary file first which then replaces path, so a crash while saving never
+// leaves a half written snapshot behind.
+func saveSnapshot(ds *Dataset, path, format string) error {
+	tmpPath := filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-%d.bdb", os.Getpid()))
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	write := ds.WriteSnapshot
+	if format == snapshotFormatRedis {
+		write = ds.WriteRDB
+	}
+	if err := write(f); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// loadSnapshot reads the snapshot at path, which can also be a Redis RDB file.
+// It returns nil and no error when there is no snapshot to load.
+func loadSnapshot(path string) (*Dataset, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rd := bufio.NewReader(f)
+	if magic, _ := rd.Peek(len(rdbMagic)); string(magic) == rdbMagic {
+		return ReadRDB(rd)
+	}
+	return ReadSnapshot(rd)
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// Commands that work on the content of string keys. The ones that change an
+// existing string change it in place, so the key keeps its deadline.
+
+// Largest string a command can build, the proto-max-bulk-len of Redis.
+const maxStringLength = 512 * 1024 * 1024
+
+var (
+	notInteger = resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+	notFloat   = resp.Value{Typ: "error", Str: "ERR value is not a valid float"}
+	tooLong    = resp.Value{Typ: "error", Str: "ERR string exceeds maximum allowed size (proto-max-bulk-len)"}
+)
+
+// lookupString returns the string stored at key for a write command, nil when
+// there is none.
+func lookupString(db *Keyspace, key string) (*Object, *resp.Value) {
+	obj := db.lookupKeyWrite(key)
+	if obj != nil && obj.Type != typeString {
+		return nil, &wrongType
+	}
+	return obj, nil
+}
+
+// parseInteger parses s the way Redis reads integers out of strings: a base 10
+// number without sign other than a leading minus, spaces or leading zeros.
+func parseInteger(s string) (int64, bool) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != s {
+		return 0, false
+	}
+	return n, true
+}
+
+// setOptions are the options of SET, or those of GETEX.
+type setOptions struct {
+	nx, xx, get, keepTTL, persist bool
+
+	expiry string     // EX, PX, EXAT or PXAT, empty when no deadline is given
+	when   resp.Value // Argument of expiry
+}
+
+// The options giving a deadline: the unit of their argument, and whether it is
+// a unix time rather than a time from now.
+var expiryOptions = map[string]struct {
+	unit     time.Duration
+	absolute bool
+}{
+	"EX":   {time.Second, false},
+	"PX":   {time.Millisecond, false},
+	"EXAT": {time.Second, true},
+	"PXAT": {time.Millisecond, true},
+}
+
+// parseSetOptions parses the options following the key and value of SET, or
+// the key of GETEX when getex is set. An option can be repeated, but NX and XX
+// exclude each other, as do the ways of giving a deadline or keeping it.
+func parseSetOptions(args []resp.Value, getex bool) (setOptions, *resp.Value) {
+	var opts setOptions
+	for i := 0; i < len(args); i++ {
+		option := strings.ToUpper(args[i].Bulk)
+		_, expiry := expiryOptions[option]
+		switch {
+		case option == "NX" && !getex && !opts.xx:
+			opts.nx = true
+		case option == "XX" && !getex && !opts.nx:
+			opts.xx = true
+		case option == "GET" && !getex:
+			opts.get = true
+		case option == "KEEPTTL" && !getex && opts.expiry == "":
+			opts.keepTTL = true
+		case option == "PERSIST" && getex && opts.expiry == "":
+			opts.persist = true
+		case expiry && !opts.keepTTL && !opts.persist && (opts.expiry == "" || opts.expiry == option) && i+1 < len(args):
+			opts.expiry = option
+			opts.when = args[i+1]
+			i++
+		default:
+			return opts, &resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+	}
+	return opts, nil
+}
+
+// deadline returns the deadline given to command name by opts, the zero time
+// when there is none. It must be in the future when relative, and after the
+// epoch when absolute.
+func (opts setOptions) deadline(name string) (time.Time, *resp.Value) {
+	if opts.expiry == "" {
+		return time.Time{}, nil
+	}
+	when, ok := parseInteger(opts.when.Bulk)
+	if !ok {
+		return time.Time{}, &notInteger
+	}
+
+	invalid := &resp.Value{Typ: "error", Str: fmt.Sprintf("ERR invalid expire time in '%s' command", name)}
+	option := expiryOptions[opts.expiry]
+	factor := int64(option.unit / time.Millisecond)
+	if when <= 0 || when > math.MaxInt64/factor {
+		return time.Time{}, invalid
+	}
+	ms := when * factor
+	if !option.absolute {
+		now := time.Now().UnixMilli()
+		if ms > math.MaxInt64-now {
+			return time.Time{}, invalid
+		}
+		ms += now
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// stringSet reports whether a command of the SET family that replied result
+// stored its value, which NX and XX can prevent.
+func stringSet(command string, args []resp.Value, result resp.Value) bool {
+	switch command {
+	case "SETNX":
+		return result.Num == 1
+	case "SET":
+		// With GET the reply is the previous string, which tells whether the
+		// condition was met
+		opts, _ := parseSetOptions(args[2:], false)
+		switch {
+		case !opts.get:
+			return result.Typ != "null"
+		case opts.nx:
+			return result.Typ == "null"
+		case opts.xx:
+			return result.Typ != "null"
+		}
+	}
+	return true
+}
+
+// setnx implements SETNX key value, which replies 1 when the key was set and
+// 0 when it already existed.
+func setnx(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'setnx' command"}
+	}
+	result := setCommand(db, "setnx", []resp.Value{args[0], args[1], {Typ: "bulk", Bulk: "NX"}})
+	if result.Typ == "null" {
+		return resp.Value{Typ: "integer", Num: 0}
+	}
+	return resp.Value{Typ: "integer", Num: 1}
+}
+
+func setex(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'setex' command"}
+	}
+	return setCommand(db, "setex", []resp.Value{args[0], args[2], {Typ: "bulk", Bulk: "EX"}, args[1]})
+}
+
+func psetex(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'psetex' command"}
+	}
+	return setCommand(db, "psetex", []resp.Value{args[0], args[2], {Typ: "bulk", Bulk: "PX"}, args[1]})
+}
+
+// getset implements GETSET key value, the same as SET key value GET.
+func getset(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'getset' command"}
+	}
+	return setCommand(db, "getset", []resp.Value{args[0], args[1], {Typ: "bulk", Bulk: "GET"}})
+}
+
+// getdel implements GETDEL key, which replies with the string and deletes it.
+func getdel(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'getdel' command"}
+	}
+
+	key := args[0].Bulk
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	obj, errValue := lookupString(db, key)
+	if errValue != nil {
+		return *errValue
+	}
+	if obj == nil {
+		return resp.Value{Typ: "null"}
+	}
+	db.delete(key)
+	return resp.Value{Typ: "bulk", Bulk: obj.Content}
+}
+
+// getex implements GETEX key [EX seconds|PX milliseconds|EXAT
+// unix-time-seconds|PXAT unix-time-milliseconds|PERSIST], which replies with
+// the string and sets or removes its deadline.
+func getex(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'getex' command"}
+	}
+	opts, errValue := parseSetOptions(args[1:], true)
+	if errValue != nil {
+		return *errValue
+	}
+	deadline, errValue := opts.deadline("getex")
+	if errValue != nil {
+		return *errValue
+	}
+
+	key := args[0].Bulk
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	obj, errValue := lookupString(db, key)
+	if errValue != nil {
+		return *errValue
+	}
+	if obj == nil {
+		return resp.Value{Typ: "null"}
+	}
+
+	switch {
+	case !deadline.IsZero() && !deadline.After(time.Now()) && !loading:
+		db.delete(key)
+	case !deadline.IsZero():
+		db.setExpiry(key, obj, deadline)
+	case opts.persist:
+		db.persist(key, obj)
+	}
+	return resp.Value{Typ: "bulk", Bulk: obj.Content}
+}
+
+// mget implements MGET key [key ...]. The reply has the string stored at
+// each key, null for keys that are missing or hold another type.
+func mget(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'mget' command"}
+	}
+
+	keyspaceMu.RLock()
+	defer keyspaceMu.RUnlock()
+	replies := make([]resp.Value, len(args))
+	for i, arg := range args {
+		replies[i] = resp.Value{Typ: "null"}
+		if obj := db.lookupKey(arg.Bulk); obj != nil && obj.Type == typeString {
+			replies[i] = resp.Value{Typ: "bulk", Bulk: obj.Content}
+		}
+	}
+	return resp.Value{Typ: "array", Array: replies}
+}
+
+// mset implements MSET key value [key value ...], a SET of every pair made at
+// once. The last value wins when a key is given twice.
+func mset(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'mset' command"}
+	}
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	msetPairs(db, args)
+	return resp.Value{Typ: "string", Str: "OK"}
+}
+
+// msetnx implements MSETNX key value [key value ...], which sets the keys only
+// when none of them exists. It replies 1 when they were set and 0 otherwise.
+func msetnx(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'msetnx' command"}
+	}
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	for i := 0; i < len(args); i += 2 {
+		if db.lookupKeyWrite(args[i].Bulk) != nil {
+			return resp.Value{Typ: "integer", Num: 0}
+		}
+	}
+	msetPairs(db, args)
+	return resp.Value{Typ: "integer", Num: 1}
+}
+
+// msetPairs stores the key value pairs of MSET, replacing whatever the keys
+// held along with their deadlines.
+func msetPairs(db *Keyspace, args []resp.Value) {
+	for i := 0; i < len(args); i += 2 {
+		db.set(args[i].Bulk, newString(args[i+1].Bulk))
+	}
+}
+
+func incr(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'incr' command"}
+	}
+	return incrBy(db, args[0].Bulk, 1)
+}
+
+func decr(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'decr' command"}
+	}
+	return incrBy(db, args[0].Bulk, -1)
+}
+
+func incrby(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'incrby' command"}
+	}
+	delta, ok := parseInteger(args[1].Bulk)
+	if !ok {
+		return notInteger
+	}
+	return incrBy(db, args[0].Bulk, delta)
+}
+
+func decrby(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'decrby' command"}
+	}
+	delta, ok := parseInteger(args[1].Bulk)
+	if !ok {
+		return notInteger
+	}
+	if delta == math.MinInt64 {
+		return resp.Value{Typ: "error", Str: "ERR decrement would overflow"}
+	}
+	return incrBy(db, args[0].Bulk, -delta)
+}
+
+// incrBy adds delta to the integer stored at key, a missing key counting as 0,
+// and replies with the result.
+func incrBy(db *Keyspace, key string, delta int64) resp.Value {
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	obj, errValue := lookupString(db, key)
+	if errValue != nil {
+		return *errValue
+	}
+
+	var n int64
+	if obj != nil {
+		var ok bool
+		if n, ok = parseInteger(obj.Content); !ok {
+			return notInteger
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return resp.Value{Typ: "error", Str: "ERR increment or decrement would overflow"}
+	}
+	n += delta
+
+	if obj == nil {
+		db.set(key, newString(strconv.FormatInt(n, 10)))
+	} else {
+		obj.Content = strconv.FormatInt(n, 10)
+	}
+	return resp.Value{Typ: "integer", Num: int(n)}
+}
+
+// incrbyfloat implements INCRBYFLOAT key increment. The result is stored in
+// its shortest decimal form, so it is logged to the AOF as a SET of that value
+// rather than replayed as an addition that could round differently.
+func incrbyfloat(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'incrbyfloat' command"}
+	}
+	delta, ok := parseFloat(args[1].Bulk)
+	if !ok {
+		return notFloat
+	}
+
+	key := args[0].Bulk
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	obj, errValue := lookupString(db, key)
+	if errValue != nil {
+		return *errValue
+	}
+
+	var f float64
+	if obj != nil {
+		if f, ok = parseFloat(obj.Content); !ok {
+			return notFloat
+		}
+	}
+	f += delta
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return resp.Value{Typ: "error", Str: "ERR increment would produce NaN or Infinity"}
+	}
+
+	content := strconv.FormatFloat(f, 'f', -1, 64)
+	if obj == nil {
+		db.set(key, newString(content))
+	} else {
+		obj.Content = content
+	}
+	return resp.Value{Typ: "bulk", Bulk: content}
+}
+
+// parseFloat parses a finite floating point number.
+func parseFloat(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+	return f, true
+}
+
+// appendHandler implements APPEND key value, which creates the key when it
+// does not exist, and replies with the new length.
+func appendHandler(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'append' command"}
+	}
+
+	key, value := args[0].Bulk, args[1].Bulk
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	obj, errValue := lookupString(db, key)
+	if errValue != nil {
+		return *errValue
+	}
+	if obj == nil {
+		db.set(key, newString(value))
+		return resp.Value{Typ: "integer", Num: len(value)}
+	}
+	if len(obj.Content)+len(value) > maxStringLength {
+		return tooLong
+	}
+	obj.Content += value
+	return resp.Value{Typ: "integer", Num: len(obj.Content)}
+}
+
+// strlen implements STRLEN key, 0 for a missing key.
+func strlen(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'strlen' command"}
+	}
+
+	keyspaceMu.RLock()
+	defer keyspaceMu.RUnlock()
+	obj := db.lookupKey(args[0].Bulk)
+	if obj == nil {
+		return resp.Value{Typ: "integer", Num: 0}
+	}
+	if obj.Type != typeString {
+		return wrongType
+	}
+	return resp.Value{Typ: "integer", Num: len(obj.Content)}
+}
+
+// getrange implements GETRANGE key start end, the bytes from start to end
+// both included. Negative offsets count from the end of the string, -1 being
+// the last byte, and the range is clamped to the string.
+func getrange(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'getrange' command"}
+	}
+	start, ok1 := parseInteger(args[1].Bulk)
+	end, ok2 := parseInteger(args[2].Bulk)
+	if !ok1 || !ok2 {
+		return notInteger
+	}
+
+	keyspaceMu.RLock()
+	defer keyspaceMu.RUnlock()
+	obj := db.lookupKey(args[0].Bulk)
+	if obj != nil && obj.Type != typeString {
+		return wrongType
+	}
+	var content string
+	if obj != nil {
+		content = obj.Content
+	}
+
+	empty := resp.Value{Typ: "bulk", Bulk: ""}
+	n := int64(len(content))
+	if start < 0 && end < 0 && start > end {
+		return empty
+	}
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if end < 0 {
+		end = max(n+end, 0)
+	}
+	end = min(end, n-1)
+	if start > end || n == 0 {
+		return empty
+	}
+	return resp.Value{Typ: "bulk", Bulk: content[start : end+1]}
+}
+
+// setrange implements SETRANGE key offset value. The string is padded with
+// zero bytes up to offset when it is shorter, and created when missing unless
+// value is empty. It replies with the new length.
+func setrange(db *Keyspace, args []resp.Value) resp.Value {
+	if len(args) != 3 {
+		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'setrange' command"}
+	}
+	offset, ok := parseInteger(args[1].Bulk)
+	if !ok {
+		return notInteger
+	}
+	if offset < 0 {
+		return resp.Value{Typ: "error", Str: "ERR offset is out of range"}
+	}
+
+	key, value := args[0].Bulk, args[2].Bulk
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	obj, errValue := lookupString(db, key)
+	if errValue != nil {
+		return *errValue
+	}
+
+	var content string
+	if obj != nil {
+		content = obj.Content
+	}
+	if value == "" {
+		return resp.Value{Typ: "integer", Num: len(content)}
+	}
+	if offset > maxStringLength-int64(len(value)) {
+		return tooLong
+	}
+
+	b := []byte(content)
+	if end := int(offset) + len(value); end > len(b) {
+		b = append(b, make([]byte, end-len(b))...)
+	}
+	copy(b[offset:], value)
+
+	if obj == nil {
+		db.set(key, newString(string(b)))
+	} else {
+		obj.Content = string(b)
+	}
+	return resp.Value{Typ: "integer", Num: len(b)}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IAmRiteshKoushik/bluedis/resp"
+)
+
+// bulks turns strings into the arguments of a command.
+func bulks(args ...string) []resp.Value {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.Value{Typ: "bulk", Bulk: arg}
+	}
+	return values
+}
+
+// logged runs a write command and returns what it appends to the AOF, one
+// space separated string per command.
+func logged(db *Keyspace, name string, args ...string) []string {
+	values := bulks(args...)
+	result := Handlers[name](db, values)
+	var entries []string
+	for _, entry := range aofEntries(db, name, values, result) {
+		var words []string
+		for _, arg := range entry.Array {
+			words = append(words, arg.Bulk)
+		}
+		entries = append(entries, strings.Join(words, " "))
+	}
+	return entries
+}
+
+func wantReply(t *testing.T, got, want resp.Value, what string) {
+	t.Helper()
+	if got.Typ != want.Typ || got.Str != want.Str || got.Bulk != want.Bulk || got.Num != want.Num {
+		t.Errorf("%s = %+v, want %+v", what, got, want)
+	}
+}
+
+func TestParseSetOptions(t *testing.T) {
+	tests := []struct {
+		args  string
+		getex bool
+		ok    bool
+	}{
+		{"", false, true},
+		{"nx get ex 10", false, true},
+		{"XX GET KEEPTTL", false, true},
+		{"NX NX", false, true},
+		{"EX 10 EX 20", false, true},
+		{"NX XX", false, false},
+		{"XX NX", false, false},
+		{"EX 10 PX 10", false, false},
+		{"EX 10 KEEPTTL", false, false},
+		{"KEEPTTL PXAT 10", false, false},
+		{"EX", false, false},
+		{"PERSIST", false, false},
+		{"BOGUS", false, false},
+
+		{"PERSIST", true, true},
+		{"EXAT 10", true, true},
+		{"PERSIST EX 10", true, false},
+		{"EX 10 PERSIST", true, false},
+		{"NX", true, false},
+		{"GET", true, false},
+		{"KEEPTTL", true, false},
+	}
+	for _, tt := range tests {
+		_, errValue := parseSetOptions(bulks(strings.Fields(tt.args)...), tt.getex)
+		if ok := errValue == nil; ok != tt.ok {
+			t.Errorf("parseSetOptions(%q, getex=%v) ok = %v, want %v", tt.args, tt.getex, ok, tt.ok)
+		}
+	}
+}
+
+func TestSetOptionsDeadline(t *testing.T) {
+	invalid := resp.Value{Typ: "error", Str: "ERR invalid expire time in 'set' command"}
+	maxInt := strconv.FormatInt(math.MaxInt64, 10)
+	tests := []struct {
+		option, when string
+		err          *resp.Value
+	}{
+		{"EX", "10", nil},
+		{"PXAT", maxInt, nil},
+		{"EX", "0", &invalid},
+		{"PX", "-1", &invalid},
+		{"EXAT", "0", &invalid},
+		{"EX", maxInt, &invalid},
+		{"EXAT", strconv.FormatInt(math.MaxInt64/1000+1, 10), &invalid},
+		{"PX", strconv.FormatInt(math.MaxInt64-1000, 10), &invalid},
+		{"EX", "1.5", &notInteger},
+		{"EX", "010", &notInteger},
+	}
+	for _, tt := range tests {
+		opts, _ := parseSetOptions(bulks(tt.option, tt.when), false)
+		_, errValue := opts.deadline("set")
+		switch {
+		case tt.err == nil && errValue != nil:
+			t.Errorf("%s %s: %s", tt.option, tt.when, errValue.Str)
+		case tt.err != nil && (errValue == nil || errValue.Str != tt.err.Str):
+			t.Errorf("%s %s = %v, want %q", tt.option, tt.when, errValue, tt.err.Str)
+		}
+	}
+
+	opts, _ := parseSetOptions(bulks("EXAT", "2000000000"), false)
+	if deadline, _ := opts.deadline("set"); deadline.Unix() != 2000000000 {
+		t.Errorf("EXAT 2000000000 gave %v", deadline)
+	}
+}
+
+func TestSetConditions(t *testing.T) {
+	ok := resp.Value{Typ: "string", Str: "OK"}
+	null := resp.Value{Typ: "null"}
+	tests := []struct {
+		args string
+		want resp.Value
+		left string // Value of the key afterwards, empty when missing
+	}{
+		{"missing v NX", ok, "v"},
+		{"missing v XX", null, ""},
+		{"missing v NX GET", null, "v"},
+		{"missing v XX GET", null, ""},
+		{"missing v GET", null, "v"},
+		{"key v NX", null, "old"},
+		{"key v XX", ok, "v"},
+		{"key v NX GET", resp.Value{Typ: "bulk", Bulk: "old"}, "old"},
+		{"key v XX GET", resp.Value{Typ: "bulk", Bulk: "old"}, "v"},
+		{"key v EXAT 1", ok, ""},
+		{"key v PXAT 1 GET", resp.Value{Typ: "bulk", Bulk: "old"}, ""},
+	}
+	for _, tt := range tests {
+		db := newKeyspace(0)
+		command(db, "SET", "key", "old")
+		args := strings.Fields(tt.args)
+		wantReply(t, command(db, "SET", args...), tt.want, "SET "+tt.args)
+		if got := command(db, "GET", args[0]); got.Bulk != tt.left {
+			t.Errorf("after SET %s the key holds %q, want %q", tt.args, got.Bulk, tt.left)
+		}
+	}
+}
+
+func TestSetGetOnOtherType(t *testing.T) {
+	db := newKeyspace(0)
+	command(db, "RPUSH", "list", "a")
+	wantReply(t, command(db, "SET", "list", "v", "GET"), wrongType, "SET list v GET")
+	wantReply(t, command(db, "GETSET", "list", "v"), wrongType, "GETSET list v")
+	wantReply(t, command(db, "GETEX", "list"), wrongType, "GETEX list")
+	wantReply(t, command(db, "GETDEL", "list"), wrongType, "GETDEL list")
+	if got := command(db, "TYPE", "list"); got.Str != "list" {
+		t.Errorf("the list became a %s", got.Str)
+	}
+
+	// Without GET the list is replaced
+	wantReply(t, command(db, "SET", "list", "v"), resp.Value{Typ: "string", Str: "OK"}, "SET list v")
+	wantReply(t, command(db, "GET", "list"), resp.Value{Typ: "bulk", Bulk: "v"}, "GET list")
+}
+
+func TestSetKeepTTL(t *testing.T) {
+	db := newKeyspace(0)
+	command(db, "SET", "key", "old", "EX", "100")
+	command(db, "SET", "key", "kept", "KEEPTTL")
+	wantInteger(t, command(db, "TTL", "key"), 100, "TTL after KEEPTTL")
+	command(db, "SET", "key", "new")
+	wantInteger(t, command(db, "TTL", "key"), -1, "TTL after SET")
+}
+
+func TestSetLogged(t *testing.T) {
+	db := newKeyspace(0)
+	deadline := time.Now().Add(time.Hour).UnixMilli()
+	pexpireat := fmt.Sprintf("PEXPIREAT key %d", deadline)
+	tests := []struct {
+		name string
+		args string
+		want []string
+	}{
+		{"SET", "key v", []string{"SET key v"}},
+		{"SET", "key v NX", nil},
+		{"SET", "key w XX GET", []string{"SET key w"}},
+		{"SET", fmt.Sprintf("key v PXAT %d", deadline), []string{"SET key v", pexpireat}},
+		// The deadline KEEPTTL kept is logged along with the value
+		{"SET", "key w KEEPTTL", []string{"SET key w", pexpireat}},
+		{"SETNX", "key v", nil},
+		{"GETSET", "key x", []string{"SET key x"}},
+		{"SETEX", "key 0 v", nil},
+		{"SET", "key v EXAT 1", []string{"DEL key"}},
+		{"GETDEL", "key", nil},
+		{"SETNX", "key v", []string{"SET key v"}},
+		{"GETEX", "key", nil},
+		{"GETEX", fmt.Sprintf("key PXAT %d", deadline), []string{pexpireat}},
+		{"GETEX", "key PERSIST", []string{"PERSIST key"}},
+		{"GETDEL", "key", []string{"DEL key"}},
+		{"GETEX", "key PERSIST", nil},
+	}
+	for _, tt := range tests {
+		got := logged(db, tt.name, strings.Fields(tt.args)...)
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s %s logged %q, want %q", tt.name, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestIncrBy(t *testing.T) {
+	overflow := resp.Value{Typ: "error", Str: "ERR increment or decrement would overflow"}
+	maxInt := strconv.FormatInt(math.MaxInt64, 10)
+	minInt := strconv.FormatInt(math.MinInt64, 10)
+	tests := []struct {
+		content string // Empty for a missing key
+		name    string
+		args    []string
+		want    resp.Value
+	}{
+		{"", "INCR", nil, resp.Value{Typ: "integer", Num: 1}},
+		{"", "DECRBY", []string{"5"}, resp.Value{Typ: "integer", Num: -5}},
+		{"10", "INCRBY", []string{"-15"}, resp.Value{Typ: "integer", Num: -5}},
+		{maxInt, "INCR", nil, overflow},
+		{maxInt, "INCRBY", []string{"0"}, resp.Value{Typ: "integer", Num: math.MaxInt64}},
+		{minInt, "DECR", nil, overflow},
+		{"-1", "INCRBY", []string{minInt}, overflow},
+		{"0", "INCRBY", []string{minInt}, resp.Value{Typ: "integer", Num: math.MinInt64}},
+		{"1", "DECRBY", []string{maxInt}, resp.Value{Typ: "integer", Num: 1 - math.MaxInt64}},
+		{"0", "DECRBY", []string{minInt}, resp.Value{Typ: "error", Str: "ERR decrement would overflow"}},
+		{"0", "INCRBY", []string{"1.5"}, notInteger},
+		{"0", "INCRBY", []string{"+1"}, notInteger},
+		{"abc", "INCR", nil, notInteger},
+		{" 1", "INCR", nil, notInteger},
+		{"01", "INCR", nil, notInteger},
+		{maxInt + "0", "INCR", nil, notInteger},
+	}
+	for _, tt := range tests {
+		db := newKeyspace(0)
+		if tt.content != "" {
+			command(db, "SET", "key", tt.content)
+		}
+		what := fmt.Sprintf("%s %q %v", tt.name, tt.content, tt.args)
+		wantReply(t, command(db, tt.name, append([]string{"key"}, tt.args...)...), tt.want, what)
+	}
+
+	// A failed increment leaves the key as it was, deadline included
+	db := newKeyspace(0)
+	command(db, "SET", "key", maxInt, "EX", "100")
+	command(db, "INCR", "key")
+	wantReply(t, command(db, "GET", "key"), resp.Value{Typ: "bulk", Bulk: maxInt}, "GET after overflow")
+	command(db, "DECR", "key")
+	wantInteger(t, command(db, "TTL", "key"), 100, "TTL after DECR")
+
+	command(db, "RPUSH", "list", "a")
+	wantReply(t, command(db, "INCR", "list"), wrongType, "INCR list")
+}
+
+func TestIncrByFloat(t *testing.T) {
+	tests := []struct {
+		content, delta string // content is empty for a missing key
+		want           resp.Value
+	}{
+		{"", "1.5", resp.Value{Typ: "bulk", Bulk: "1.5"}},
+		{"10.50", "0.1", resp.Value{Typ: "bulk", Bulk: "10.6"}},
+		{"5", "-5", resp.Value{Typ: "bulk", Bulk: "0"}},
+		{"3", "2", resp.Value{Typ: "bulk", Bulk: "5"}},
+		{"5.0e3", "2.0e2", resp.Value{Typ: "bulk", Bulk: "5200"}},
+		{"0", "1e-5", resp.Value{Typ: "bulk", Bulk: "0.00001"}},
+		{"0", "abc", notFloat},
+		{"0", "inf", notFloat},
+		{"0", "nan", notFloat},
+		{"abc", "1", notFloat},
+		{"1e308", "1e308", resp.Value{Typ: "error", Str: "ERR increment would produce NaN or Infinity"}},
+	}
+	for _, tt := range tests {
+		db := newKeyspace(0)
+		if tt.content != "" {
+			command(db, "SET", "key", tt.content)
+		}
+		what := fmt.Sprintf("INCRBYFLOAT %q %s", tt.content, tt.delta)
+		wantReply(t, command(db, "INCRBYFLOAT", "key", tt.delta), tt.want, what)
+	}
+
+	// The result is logged as the string it left rather than as an addition
+	db := newKeyspace(0)
+	command(db, "SET", "key", "10.50")
+	if got := logged(db, "INCRBYFLOAT", "key", "0.1"); len(got) != 1 || got[0] != "SET key 10.6" {
+		t.Errorf("INCRBYFLOAT logged %q, want [SET key 10.6]", got)
+	}
+}
+
+func TestGetrange(t *testing.T) {
+	tests := []struct {
+		start, end string
+		want       string
+	}{
+		{"0", "3", "Hell"},
+		{"-3", "-1", "rld"},
+		{"0", "-1", "Hello World"},
+		{"10", "100", "d"},
+		{"-100", "2", "Hel"},
+		{"5", "3", ""},
+		{"-1", "-5", ""},
+		{"20", "30", ""},
+		{"11", "-1", ""},
+	}
+	db := newKeyspace(0)
+	command(db, "SET", "key", "Hello World")
+	for _, tt := range tests {
+		what := fmt.Sprintf("GETRANGE key %s %s", tt.start, tt.end)
+		wantReply(t, command(db, "GETRANGE", "key", tt.start, tt.end), resp.Value{Typ: "bulk", Bulk: tt.want}, what)
+	}
+	wantReply(t, command(db, "GETRANGE", "missing", "0", "-1"), resp.Value{Typ: "bulk"}, "GETRANGE missing")
+	wantReply(t, command(db, "GETRANGE", "key", "0", "x"), notInteger, "GETRANGE key 0 x")
+}
+
+func TestSetrange(t *testing.T) {
+	tooLong := resp.Value{Typ: "error", Str: "ERR string exceeds maximum allowed size (proto-max-bulk-len)"}
+	tests := []struct {
+		content, offset, value string // content is empty for a missing key
+		want                   resp.Value
+		left                   string
+	}{
+		{"Hello World", "6", "Redis", resp.Value{Typ: "integer", Num: 11}, "Hello Redis"},
+		{"Hello", "5", "!!", resp.Value{Typ: "integer", Num: 7}, "Hello!!"},
+		{"", "3", "x", resp.Value{Typ: "integer", Num: 4}, "\x00\x00\x00x"},
+		{"", "3", "", resp.Value{Typ: "integer", Num: 0}, ""},
+		{"Hello", "100", "", resp.Value{Typ: "integer", Num: 5}, "Hello"},
+		{"Hello", "-1", "x", resp.Value{Typ: "error", Str: "ERR offset is out of range"}, "Hello"},
+		{"Hello", strconv.Itoa(maxStringLength), "x", tooLong, "Hello"},
+		{"Hello", strconv.FormatInt(math.MaxInt64, 10), "x", tooLong, "Hello"},
+		{"Hello", "x", "x", notInteger, "Hello"},
+	}
+	for _, tt := range tests {
+		db := newKeyspace(0)
+		if tt.content != "" {
+			command(db, "SET", "key", tt.content)
+		}
+		what := fmt.Sprintf("SETRANGE %q %s %q", tt.content, tt.offset, tt.value)
+		wantReply(t, command(db, "SETRANGE", "key", tt.offset, tt.value), tt.want, what)
+		if got := command(db, "GET", "key"); got.Bulk != tt.left {
+			t.Errorf("after %s the key holds %q, want %q", what, got.Bulk, tt.left)
+		}
+	}
+	wantInteger(t, command(newKeyspace(0), "EXISTS", "key"), 0, "EXISTS after an empty SETRANGE")
+
+	// Only a SETRANGE that writes something is logged
+	db := newKeyspace(0)
+	command(db, "SET", "key", "Hello")
+	if got := logged(db, "SETRANGE", "key", "1", ""); got != nil {
+		t.Errorf("an empty SETRANGE logged %q", got)
+	}
+	if got := logged(db, "SETRANGE", "key", "1", "a"); len(got) != 1 || got[0] != "SETRANGE key 1 a" {
+		t.Errorf("SETRANGE logged %q, want [SETRANGE key 1 a]", got)
+	}
+}
+
+func TestAppendStrlen(t *testing.T) {
+	db := newKeyspace(0)
+	wantInteger(t, command(db, "STRLEN", "key"), 0, "STRLEN missing")
+	wantInteger(t, command(db, "APPEND", "key", "Hello"), 5, "APPEND to a missing key")
+	command(db, "EXPIRE", "key", "100")
+	wantInteger(t, command(db, "APPEND", "key", " World"), 11, "APPEND")
+	wantInteger(t, command(db, "STRLEN", "key"), 11, "STRLEN")
+	wantInteger(t, command(db, "TTL", "key"), 100, "TTL after APPEND")
+
+	command(db, "RPUSH", "list", "a")
+	wantReply(t, command(db, "APPEND", "list", "x"), wrongType, "APPEND list")
+	wantReply(t, command(db, "STRLEN", "list"), wrongType, "STRLEN list")
+}
+
+func TestMsetnx(t *testing.T) {
+	db := newKeyspace(0)
+	command(db, "SET", "a", "old")
+	wantInteger(t, command(db, "MSETNX", "a", "1", "b", "2"), 0, "MSETNX with a existing")
+	wantInteger(t, command(db, "EXISTS", "b"), 0, "EXISTS b")
+	if got := logged(db, "MSETNX", "b", "2", "a", "1"); got != nil {
+		t.Errorf("a failed MSETNX logged %q", got)
+	}
+
+	// Any type counts as existing
+	command(db, "RPUSH", "list", "x")
+	wantInteger(t, command(db, "MSETNX", "b", "2", "list", "1"), 0, "MSETNX with a list")
+
+	// An expired key is as good as missing
+	command(db, "PEXPIRE", "a", "1")
+	time.Sleep(10 * time.Millisecond)
+	defer takeExpiredKeys()
+	if got := logged(db, "MSETNX", "a", "1", "b", "2", "a", "3"); len(got) != 1 || got[0] != "MSET a 1 b 2 a 3" {
+		t.Errorf("MSETNX logged %q, want [MSET a 1 b 2 a 3]", got)
+	}
+	got := command(db, "MGET", "a", "b", "list", "missing")
+	if len(got.Array) != 4 {
+		t.Fatalf("MGET = %v, want 4 replies", got)
+	}
+	want := []resp.Value{{Typ: "bulk", Bulk: "3"}, {Typ: "bulk", Bulk: "2"}, {Typ: "null"}, {Typ: "null"}}
+	for i := range want {
+		wantReply(t, got.Array[i], want[i], "MGET element "+strconv.Itoa(i))
+	}
+	wantInteger(t, command(db, "TTL", "a"), -1, "TTL a")
+}